@@ -17,6 +17,7 @@ import (
 	"flag"
 	"log"
 
+	"github.com/sirupsen/logrus"
 	"github.com/vultr/vultr-csi/driver"
 )
 
@@ -30,6 +31,29 @@ func main() {
 		apiURL     = flag.String("api-url", "", "Vultr API URL")
 		driverName = flag.String("driver-name", driver.DefaultDriverName, "Name of driver")
 		userAgent  = flag.String("user-agent", "", "Custom user agent")
+
+		statusCheckRetries = flag.Int("volume-status-check-retries", driver.DefaultVolumeStatusCheckRetries,
+			"Number of times to poll a volume while waiting on it, the total wait must stay within the sidecar --timeout")
+		statusCheckInterval = flag.Duration("volume-status-check-interval", driver.DefaultVolumeStatusCheckInterval,
+			"Initial interval between volume polls")
+		statusCheckMaxInterval = flag.Duration("volume-status-check-max-interval", driver.DefaultVolumeStatusCheckMaxInterval,
+			"Maximum interval between volume polls")
+
+		maxVolumesPerNode = flag.Int("max-volumes-per-node", driver.DefaultMaxVolumesPerNode,
+			"Maximum number of volumes that can be attached to a single node")
+
+		defaultVolumeSizeGB = flag.Int("default-volume-size-gb", 0,
+			"Size in GB of volumes requested without a capacity, 0 uses the default of the block type")
+		requireCapacity = flag.Bool("require-capacity", false, "Reject volumes requested without a capacity instead of using the default size")
+
+		forceDetach = flag.Bool("force-detach", false,
+			"Detach a volume from a node that is no longer running when it is published to another node")
+
+		logLevel = flag.String("log-level", "info", "Log level: trace, debug, info, warn, error, fatal or panic")
+
+		debugAddr = flag.String("debug-addr", "",
+			"Address to serve the unauthenticated volume debug endpoint on, a port alone binds to loopback, disabled when empty")
+		strictIdempotency = flag.Bool("strict-idempotency", false, "Verify volume state before and after every mutating call (debugging aid)")
 	)
 	flag.Parse()
 
@@ -37,7 +61,21 @@ func main() {
 		log.Fatal("version must be defined at compilation")
 	}
 
-	d, err := driver.NewDriver(*endpoint, *token, *driverName, version, *userAgent, *apiURL)
+	level, err := logrus.ParseLevel(*logLevel)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	d, err := driver.NewDriver(*endpoint, *token, *driverName, version, *userAgent, *apiURL,
+		driver.WithStrictIdempotency(*strictIdempotency),
+		driver.WithDebugAddr(*debugAddr),
+		driver.WithVolumeStatusCheck(*statusCheckRetries, *statusCheckInterval, *statusCheckMaxInterval),
+		driver.WithMaxVolumesPerNode(*maxVolumesPerNode),
+		driver.WithDefaultVolumeSizeGB(*defaultVolumeSizeGB),
+		driver.WithRequireCapacity(*requireCapacity),
+		driver.WithForceDetach(*forceDetach),
+		driver.WithLogLevel(level),
+	)
 	if err != nil {
 		log.Fatalln(err)
 	}
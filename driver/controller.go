@@ -15,6 +15,10 @@ package driver
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
 	"strconv"
 	"strings"
 	"time"
@@ -48,13 +52,59 @@ const (
 	hddMinVolumeSizeInBytes     int64 = 40 * giB
 	hddMaxVolumeSizeInBytes     int64 = 40 * tiB
 
-	volumeStatusCheckRetries  = 15
-	volumeStatusCheckInterval = 1
+	// maxVolumeLabelLength bounds the Vultr label generated from a CSI volume name
+	maxVolumeLabelLength  = 64
+	volumeLabelHashLength = 8
+
+	// fsTypeKey is the StorageClass parameter and volume context key for the filesystem type
+	fsTypeKey     = "fsType"
+	fsTypeExt4    = "ext4"
+	fsTypeXFS     = "xfs"
+	defaultFsType = fsTypeExt4
+
+	// encryptedKey is the StorageClass parameter and volume context key that enables LUKS encryption
+	encryptedKey = "encrypted"
+
+	// DefaultVolumeStatusCheckRetries is the number of times a volume is polled while waiting on it.
+	// With the default intervals the polls are 1s and then 2s apart, 15s in total, so a call that
+	// also retries a locked attach still returns within the 30s timeout of the sidecars.
+	DefaultVolumeStatusCheckRetries = 8
+	// DefaultVolumeStatusCheckInterval is the initial interval between volume polls
+	DefaultVolumeStatusCheckInterval = 1 * time.Second
+	// DefaultVolumeStatusCheckMaxInterval caps the interval between volume polls
+	DefaultVolumeStatusCheckMaxInterval = 2 * time.Second
+
+	volumeAttachRetries = 5
+
+	// instancePowerRunning is the power status of an instance that is powered on
+	instancePowerRunning = "running"
 )
 
 var (
-	supportedVolCapabilities = &csi.VolumeCapability_AccessMode{
-		Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+	// supportedAccessModes are the access modes a volume attached to a single
+	// instance can satisfy
+	supportedAccessModes = []csi.VolumeCapability_AccessMode_Mode{
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER,
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_MULTI_WRITER,
+	}
+
+	supportedBlockTypes = []string{blockTypeNvme, blockTypeHDD}
+	supportedFsTypes    = []string{fsTypeExt4, fsTypeXFS}
+
+	volumeLabelIllegalChars = regexp.MustCompile(`[^a-zA-Z0-9._-]`)
+
+	// controllerCapabilities is the source of truth for the controller RPCs
+	// that are implemented, only advertise a capability once its RPC is wired up
+	controllerCapabilities = []csi.ControllerServiceCapability_RPC_Type{
+		csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+		csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME,
+		csi.ControllerServiceCapability_RPC_LIST_VOLUMES,
+		csi.ControllerServiceCapability_RPC_LIST_VOLUMES_PUBLISHED_NODES,
+		csi.ControllerServiceCapability_RPC_EXPAND_VOLUME,
+		csi.ControllerServiceCapability_RPC_GET_VOLUME,
+		csi.ControllerServiceCapability_RPC_VOLUME_CONDITION,
+		csi.ControllerServiceCapability_RPC_SINGLE_NODE_MULTI_WRITER,
 	}
 )
 
@@ -81,20 +131,79 @@ func (c *VultrControllerServer) CreateVolume(ctx context.Context, req *csi.Creat
 		return nil, status.Error(codes.InvalidArgument, "CreateVolume Volume Capabilities is missing")
 	}
 
-	if req.Parameters["block_type"] == "" {
-		return nil, status.Error(codes.InvalidArgument, "CreateVolume Volume parameter `block_type` is missing")
+	blockType := req.Parameters["block_type"]
+	if blockType == "" {
+		blockType = blockTypeNvme
+	}
+
+	if !isSupportedBlockType(blockType) {
+		return nil, status.Errorf(codes.InvalidArgument, "CreateVolume Volume parameter `block_type` %q is not supported, must be one of: %s",
+			blockType, strings.Join(supportedBlockTypes, ", "))
+	}
+
+	// the filesystem type is only recorded when requested, the node falls back
+	// to the capability's fs type and then to ext4
+	var volumeContext map[string]string
+	if fsType := req.Parameters[fsTypeKey]; fsType != "" {
+		if !isSupportedFsType(fsType) {
+			return nil, status.Errorf(codes.InvalidArgument, "CreateVolume Volume parameter `%s` %q is not supported, must be one of: %s",
+				fsTypeKey, fsType, strings.Join(supportedFsTypes, ", "))
+		}
+		volumeContext = map[string]string{fsTypeKey: fsType}
+	}
+
+	if value, ok := req.Parameters[encryptedKey]; ok {
+		encrypted, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "CreateVolume Volume parameter `%s` %q is not a boolean", encryptedKey, value)
+		}
+
+		if encrypted {
+			if volumeContext == nil {
+				volumeContext = map[string]string{}
+			}
+			volumeContext[encryptedKey] = "true"
+		}
 	}
 
 	// Validate
 	if !isValidCapability(req.VolumeCapabilities) {
-		return nil, status.Errorf(codes.InvalidArgument, "CreateVolume Volume capability is not compatible: %v", req)
+		return nil, status.Errorf(codes.InvalidArgument, "CreateVolume Volume capability is not compatible: %v", req.VolumeCapabilities)
 	}
 
-	c.Driver.log.WithFields(logrus.Fields{
+	// never hand out a blank volume in place of restored data
+	if snapshot := req.GetVolumeContentSource().GetSnapshot(); snapshot != nil {
+		return nil, status.Errorf(codes.InvalidArgument,
+			"CreateVolume cannot restore snapshot %s, Vultr block storage does not support snapshots", snapshot.SnapshotId)
+	}
+
+	label := volumeLabel(volName)
+
+	c.Driver.logger(ctx).WithFields(logrus.Fields{
 		"volume-name":  volName,
+		"volume-label": label,
 		"capabilities": req.VolumeCapabilities,
 	}).Info("Create Volume: called")
 
+	if err := c.Driver.locks.TryAcquire(volName); err != nil {
+		return nil, err
+	}
+	defer c.Driver.locks.Release(volName)
+
+	size, err := getStorageBytes(req.CapacityRange, blockType, c.Driver.defaultVolumeSize, c.Driver.requireCapacity)
+	if err != nil {
+		return nil, err
+	}
+
+	if source := req.GetVolumeContentSource().GetVolume(); source != nil {
+		return nil, c.cloneVolumeError(ctx, source.VolumeId, req.AccessibilityRequirements, size)
+	}
+
+	regions, err := topologyRegions(req.AccessibilityRequirements, c.Driver.region)
+	if err != nil {
+		return nil, err
+	}
+
 	// check that the volume doesnt already exist
 	listOptions := &govultr.ListOptions{}
 	var curVolume *govultr.BlockStorage
@@ -102,21 +211,41 @@ func (c *VultrControllerServer) CreateVolume(ctx context.Context, req *csi.Creat
 	for {
 		volumes, meta, err := c.Driver.client.BlockStorage.List(ctx, listOptions)
 		if err != nil {
-			return nil, status.Error(codes.Internal, err.Error())
+			if ctx.Err() != nil {
+				return nil, status.FromContextError(ctx.Err()).Err()
+			}
+			return nil, apiErrorf(err, codes.Internal, "%v", err)
 		}
 
 		for i := range volumes {
-			if volumes[i].Label == volName {
+			if volumes[i].Label == label {
 				curVolume = &volumes[i]
 				break
 			}
 		}
 
 		if curVolume != nil {
+			if err := isCompatibleVolume(curVolume, req.CapacityRange, size, blockType); err != nil {
+				return nil, status.Errorf(codes.AlreadyExists, "CreateVolume volume %s already exists: %v", volName, err)
+			}
+
+			if !containsRegion(regions, curVolume.Region) {
+				return nil, status.Errorf(codes.AlreadyExists, "CreateVolume volume %s already exists in region %s, outside of %v",
+					volName, curVolume.Region, regions)
+			}
+
 			return &csi.CreateVolumeResponse{
 				Volume: &csi.Volume{
 					VolumeId:      curVolume.ID,
 					CapacityBytes: int64(curVolume.SizeGB) * giB,
+					VolumeContext: volumeContext,
+					AccessibleTopology: []*csi.Topology{
+						{
+							Segments: map[string]string{
+								"region": curVolume.Region,
+							},
+						},
+					},
 				},
 			}, nil
 		}
@@ -130,60 +259,50 @@ func (c *VultrControllerServer) CreateVolume(ctx context.Context, req *csi.Creat
 	}
 
 	// if applicable, create volume
-	size := getStorageBytes(req.CapacityRange, req.Parameters["block_type"])
-
 	blockReq := &govultr.BlockStorageCreate{
-		Region:    c.Driver.region,
 		SizeGB:    int(size / giB),
-		Label:     volName,
-		BlockType: req.Parameters["block_type"],
+		Label:     label,
+		BlockType: blockType,
 	}
 
-	volume, err := c.Driver.client.BlockStorage.Create(ctx, blockReq)
+	volume, err := c.createInPreferredRegion(ctx, blockReq, regions)
 	if err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, err
 	}
 
 	// Check to see if volume is in active state
-	volReady := false
-
-	for i := 0; i < volumeStatusCheckRetries; i++ {
-		time.Sleep(volumeStatusCheckInterval * time.Second)
-		bs, err := c.Driver.client.BlockStorage.Get(ctx, volume.ID)
-
-		if err != nil {
-			return nil, status.Error(codes.Internal, err.Error())
-		}
-
-		if bs.Status == "active" {
-			volReady = true
-			break
-		}
+	active, err := c.waitForVolume(ctx, volume.ID, "volume is not active", func(bs *govultr.BlockStorage) bool {
+		return bs.Status == "active"
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	if !volReady {
-		return nil, status.Errorf(codes.Internal, "volume is not active after %v seconds", volumeStatusCheckRetries)
+	if err := c.verifyVolume(ctx, "CreateVolume", verifyAfter, volume.ID, volumeMatches(label, blockReq.SizeGB)); err != nil {
+		return nil, err
 	}
 
 	res := &csi.CreateVolumeResponse{
 		Volume: &csi.Volume{
 			VolumeId:      volume.ID,
-			CapacityBytes: size,
+			CapacityBytes: int64(active.SizeGB) * giB,
+			VolumeContext: volumeContext,
 			AccessibleTopology: []*csi.Topology{
 				{
 					Segments: map[string]string{
-						"region": c.Driver.region,
+						"region": blockReq.Region,
 					},
 				},
 			},
 		},
 	}
 
-	c.Driver.log.WithFields(logrus.Fields{
+	c.Driver.logger(ctx).WithFields(logrus.Fields{
+		"region":      blockReq.Region,
 		"size":        size,
 		"volume-id":   volume.ID,
 		"volume-name": volume.Label,
-		"volume-size": volume.SizeGB,
+		"volume-size": active.SizeGB,
 	}).Info("Create Volume: created volume")
 
 	return res, nil
@@ -195,16 +314,21 @@ func (c *VultrControllerServer) DeleteVolume(ctx context.Context, req *csi.Delet
 		return nil, status.Error(codes.InvalidArgument, "DeleteVolume VolumeID is missing")
 	}
 
-	c.Driver.log.WithFields(logrus.Fields{
+	c.Driver.logger(ctx).WithFields(logrus.Fields{
 		"volume-id": req.VolumeId,
 	}).Info("Delete volume: called")
 
+	if err := c.Driver.locks.TryAcquire(req.VolumeId); err != nil {
+		return nil, err
+	}
+	defer c.Driver.locks.Release(req.VolumeId)
+
 	listOptions := &govultr.ListOptions{}
 	exists := false
 	for {
 		list, meta, err := c.Driver.client.BlockStorage.List(ctx, listOptions)
 		if err != nil {
-			return nil, status.Error(codes.Internal, err.Error())
+			return nil, apiErrorf(err, codes.Internal, "%v", err)
 		}
 
 		for i := range list {
@@ -225,6 +349,10 @@ func (c *VultrControllerServer) DeleteVolume(ctx context.Context, req *csi.Delet
 		return &csi.DeleteVolumeResponse{}, nil
 	}
 
+	if err := c.verifyVolume(ctx, "DeleteVolume", verifyBefore, req.VolumeId, volumeExists); err != nil {
+		return nil, err
+	}
+
 	// detach just to be safe
 	detach := &govultr.BlockStorageDetach{
 		Live: govultr.BoolToBoolPtr(true),
@@ -232,16 +360,28 @@ func (c *VultrControllerServer) DeleteVolume(ctx context.Context, req *csi.Delet
 	err := c.Driver.client.BlockStorage.Detach(ctx, req.VolumeId, detach)
 	if err != nil {
 		if !strings.Contains(err.Error(), "Block storage volume is not currently attached to a server") {
-			return nil, status.Errorf(codes.Internal, "cannot detach volume in delete, %v", err.Error())
+			return nil, apiErrorf(err, codes.Internal, "cannot detach volume in delete, %v", err.Error())
 		}
 	}
 
 	err = c.Driver.client.BlockStorage.Delete(ctx, req.VolumeId)
 	if err != nil {
-		return nil, status.Errorf(codes.Internal, "cannot delete volume, %v", err.Error())
+		// the volume may have been deleted since it was listed
+		if isNotFound(err) {
+			return &csi.DeleteVolumeResponse{}, nil
+		}
+
+		if strings.Contains(err.Error(), "attached") {
+			return nil, status.Errorf(codes.FailedPrecondition, "cannot delete volume, it is still attached: %v", err.Error())
+		}
+		return nil, apiErrorf(err, codes.Internal, "cannot delete volume, %v", err.Error())
 	}
 
-	c.Driver.log.WithFields(logrus.Fields{
+	if err := c.verifyVolume(ctx, "DeleteVolume", verifyAfter, req.VolumeId, volumeDeleted); err != nil {
+		return nil, err
+	}
+
+	c.Driver.logger(ctx).WithFields(logrus.Fields{
 		"volume-id": req.VolumeId,
 	}).Info("Delete Volume: deleted")
 
@@ -266,9 +406,14 @@ func (c *VultrControllerServer) ControllerPublishVolume(ctx context.Context, req
 		return nil, status.Error(codes.InvalidArgument, "ControllerPublishVolume read only is not currently supported")
 	}
 
+	if err := c.Driver.locks.TryAcquire(req.VolumeId); err != nil {
+		return nil, err
+	}
+	defer c.Driver.locks.Release(req.VolumeId)
+
 	volume, err := c.Driver.client.BlockStorage.Get(ctx, req.VolumeId)
 	if err != nil {
-		return nil, status.Errorf(codes.NotFound, "cannot get volume: %v", err.Error())
+		return nil, apiErrorf(err, codes.NotFound, "cannot get volume: %v", err.Error())
 	}
 
 	_, err = c.Driver.client.Instance.Get(ctx, req.NodeId)
@@ -287,54 +432,92 @@ func (c *VultrControllerServer) ControllerPublishVolume(ctx context.Context, req
 
 	// assuming its attached & to the wrong node
 	if volume.AttachedToInstance != "" {
-		return nil, status.Errorf(codes.FailedPrecondition,
-			"cannot attach volume to node because it is already attached to a different node ID: %v", volume.AttachedToInstance)
+		if !c.Driver.forceDetach {
+			return nil, status.Errorf(codes.FailedPrecondition,
+				"cannot attach volume to node because it is already attached to a different node ID: %v, "+
+					"--force-detach detaches it when that node is no longer running", volume.AttachedToInstance)
+		}
+
+		if err := c.detachFromStoppedNode(ctx, req.VolumeId, volume.AttachedToInstance); err != nil {
+			return nil, err
+		}
 	}
 
-	c.Driver.log.WithFields(logrus.Fields{
+	// publishes to the same node are serialized until the attachment shows up
+	// in the API, otherwise two of them can both count one free slot
+	if err := c.Driver.nodeLocks.Acquire(ctx, req.NodeId); err != nil {
+		return nil, err
+	}
+	defer c.Driver.nodeLocks.Release(req.NodeId)
+
+	attached, err := c.attachedVolumeCount(ctx, req.NodeId)
+	if err != nil {
+		return nil, err
+	}
+
+	if attached >= c.Driver.maxVolumesPerNode {
+		return nil, status.Errorf(codes.ResourceExhausted,
+			"cannot attach volume to node %s, it already has the maximum of %d volumes attached", req.NodeId, c.Driver.maxVolumesPerNode)
+	}
+
+	c.Driver.logger(ctx).WithFields(logrus.Fields{
 		"volume-id": req.VolumeId,
 		"node-id":   req.NodeId,
 	}).Info("Controller Publish Volume: called")
 
+	if err := c.verifyVolume(ctx, "ControllerPublishVolume", verifyBefore, req.VolumeId, volumeAttachableTo(req.NodeId)); err != nil {
+		return nil, err
+	}
+
 	attach := &govultr.BlockStorageAttach{
 		InstanceID: req.NodeId,
 		Live:       govultr.BoolToBoolPtr(true),
 	}
-	err = c.Driver.client.BlockStorage.Attach(ctx, req.VolumeId, attach)
+	err = c.attachVolume(ctx, req.VolumeId, attach)
 	if err != nil {
+		if ctx.Err() != nil {
+			return nil, status.FromContextError(ctx.Err()).Err()
+		}
+
 		// Desired node could still be spinning up
-		if strings.Contains(err.Error(), "Server is currently locked") {
+		if isInstanceLocked(err) {
 			return nil, status.Errorf(codes.Aborted, "cannot attach volume to node: %v", err.Error())
 		}
 
-		if strings.Contains(err.Error(), "Block storage volume is already attached to a server") {
-			return &csi.ControllerPublishVolumeResponse{
-				PublishContext: map[string]string{
-					c.Driver.publishVolumeID: volume.MountID,
-				},
-			}, nil
+		if !strings.Contains(err.Error(), "Block storage volume is already attached to a server") {
+			return nil, apiErrorf(err, codes.Internal, "cannot attach volume to node: %v", err.Error())
 		}
-	}
 
-	attachReady := false
-	for i := 0; i < volumeStatusCheckRetries; i++ {
-		time.Sleep(volumeStatusCheckInterval * time.Second)
-		bs, err := c.Driver.client.BlockStorage.Get(ctx, volume.ID)
-		if err != nil {
-			return nil, status.Error(codes.Internal, err.Error())
+		// the volume may have been attached elsewhere since it was fetched
+		bs, getErr := c.Driver.client.BlockStorage.Get(ctx, req.VolumeId)
+		if getErr != nil {
+			return nil, apiErrorf(getErr, codes.Internal, "%v", getErr)
 		}
 
-		if bs.AttachedToInstance == req.NodeId {
-			attachReady = true
-			break
+		if bs.AttachedToInstance != req.NodeId {
+			return nil, status.Errorf(codes.FailedPrecondition,
+				"cannot attach volume to node because it is already attached to a different node ID: %v", bs.AttachedToInstance)
 		}
+
+		return &csi.ControllerPublishVolumeResponse{
+			PublishContext: map[string]string{
+				c.Driver.publishVolumeID: volume.MountID,
+			},
+		}, nil
+	}
+
+	_, err = c.waitForVolume(ctx, volume.ID, "volume is not attached to node", func(bs *govultr.BlockStorage) bool {
+		return bs.AttachedToInstance == req.NodeId
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	if !attachReady {
-		return nil, status.Errorf(codes.Internal, "volume is not attached to node after %v seconds", volumeStatusCheckRetries)
+	if err := c.verifyVolume(ctx, "ControllerPublishVolume", verifyAfter, req.VolumeId, volumeAttachedTo(req.NodeId)); err != nil {
+		return nil, err
 	}
 
-	c.Driver.log.WithFields(logrus.Fields{
+	c.Driver.logger(ctx).WithFields(logrus.Fields{
 		"volume-id": req.VolumeId,
 		"node-id":   req.NodeId,
 	}).Info("Controller Publish Volume: published")
@@ -356,18 +539,27 @@ func (c *VultrControllerServer) ControllerUnpublishVolume(ctx context.Context, r
 		return nil, status.Error(codes.InvalidArgument, "ControllerUnpublishVolume Node ID is missing")
 	}
 
-	c.Driver.log.WithFields(logrus.Fields{
+	c.Driver.logger(ctx).WithFields(logrus.Fields{
 		"volume-id": req.VolumeId,
 		"node-id":   req.NodeId,
 	}).Info("Controller Publish Unpublish: called")
 
+	if err := c.Driver.locks.TryAcquire(req.VolumeId); err != nil {
+		return nil, err
+	}
+	defer c.Driver.locks.Release(req.VolumeId)
+
 	volume, err := c.Driver.client.BlockStorage.Get(ctx, req.VolumeId)
 	if err != nil {
-		return &csi.ControllerUnpublishVolumeResponse{}, nil
+		if isNotFound(err) {
+			return &csi.ControllerUnpublishVolumeResponse{}, nil
+		}
+		return nil, apiErrorf(err, codes.Internal, "cannot get volume: %v", err.Error())
 	}
 
-	// node is already unattached, do nothing
-	if volume.AttachedToInstance == "" {
+	// the volume is not attached to this node, it may already have been
+	// published elsewhere so it must not be detached
+	if volume.AttachedToInstance != req.NodeId {
 		return &csi.ControllerUnpublishVolumeResponse{}, nil
 	}
 
@@ -375,6 +567,11 @@ func (c *VultrControllerServer) ControllerUnpublishVolume(ctx context.Context, r
 	if err != nil {
 		return nil, status.Errorf(codes.NotFound, "cannot get node: %v", err.Error())
 	}
+
+	if err := c.verifyVolume(ctx, "ControllerUnpublishVolume", verifyBefore, req.VolumeId, volumeAttachableTo(req.NodeId)); err != nil {
+		return nil, err
+	}
+
 	detach := &govultr.BlockStorageDetach{
 		Live: govultr.BoolToBoolPtr(true),
 	}
@@ -384,10 +581,21 @@ func (c *VultrControllerServer) ControllerUnpublishVolume(ctx context.Context, r
 		if strings.Contains(err.Error(), "Block storage volume is not currently attached to a server") {
 			return &csi.ControllerUnpublishVolumeResponse{}, nil
 		}
-		return nil, status.Errorf(codes.Internal, "cannot detach volume: %v", err.Error())
+		return nil, apiErrorf(err, codes.Internal, "cannot detach volume: %v", err.Error())
 	}
 
-	c.Driver.log.WithFields(logrus.Fields{
+	_, err = c.waitForVolume(ctx, req.VolumeId, "volume is not detached from node", func(bs *govultr.BlockStorage) bool {
+		return bs.AttachedToInstance != req.NodeId
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.verifyVolume(ctx, "ControllerUnpublishVolume", verifyAfter, req.VolumeId, volumeAttachedTo("")); err != nil {
+		return nil, err
+	}
+
+	c.Driver.logger(ctx).WithFields(logrus.Fields{
 		"volume-id": req.VolumeId,
 		"node-id":   req.NodeId,
 	}).Info("Controller Unublish Volume: unpublished")
@@ -401,35 +609,46 @@ func (c *VultrControllerServer) ValidateVolumeCapabilities(ctx context.Context,
 		return nil, status.Error(codes.InvalidArgument, "ValidateVolumeCapabilities Volume ID is missing")
 	}
 
-	if req.VolumeCapabilities == nil {
+	if len(req.VolumeCapabilities) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "ValidateVolumeCapabilities Volume Capabilities is missing")
 	}
 
 	_, err := c.Driver.client.BlockStorage.Get(ctx, req.VolumeId)
 	if err != nil {
-		return nil, status.Errorf(codes.NotFound, "cannot get volume: %v", err.Error())
+		return nil, apiErrorf(err, codes.NotFound, "cannot get volume: %v", err.Error())
+	}
+
+	if !isValidCapability(req.VolumeCapabilities) {
+		return &csi.ValidateVolumeCapabilitiesResponse{
+			Message: fmt.Sprintf("volume capabilities are not supported, only %v access with a block or mount access type is supported",
+				supportedAccessModes),
+		}, nil
 	}
 
 	res := &csi.ValidateVolumeCapabilitiesResponse{
 		Confirmed: &csi.ValidateVolumeCapabilitiesResponse_Confirmed{
-			VolumeCapabilities: []*csi.VolumeCapability{
-				{
-					AccessMode: supportedVolCapabilities,
-				},
-			},
+			VolumeContext:      req.VolumeContext,
+			VolumeCapabilities: req.VolumeCapabilities,
+			Parameters:         req.Parameters,
 		},
 	}
 
 	return res, nil
 }
 
-// ListVolumes performs the list volume function
+// ListVolumes performs the list volume function. The starting token is the
+// offset of the first entry to return.
 func (c *VultrControllerServer) ListVolumes(ctx context.Context, req *csi.ListVolumesRequest) (*csi.ListVolumesResponse, error) {
-	// TODO setup paging
+	if req.MaxEntries < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "ListVolumes max_entries must not be negative: %d", req.MaxEntries)
+	}
+
+	start := 0
 	if req.StartingToken != "" {
-		_, err := strconv.Atoi(req.StartingToken)
-		if err != nil {
-			return nil, status.Errorf(codes.Aborted, "ListVolumes starting_token is invalid: %s", err)
+		var err error
+		start, err = strconv.Atoi(req.StartingToken)
+		if err != nil || start < 0 {
+			return nil, status.Errorf(codes.Aborted, "ListVolumes starting_token is invalid: %s", req.StartingToken)
 		}
 	}
 
@@ -439,7 +658,7 @@ func (c *VultrControllerServer) ListVolumes(ctx context.Context, req *csi.ListVo
 	for {
 		list, meta, err := c.Driver.client.BlockStorage.List(ctx, listOptions)
 		if err != nil {
-			return nil, status.Errorf(codes.Internal, "ListVolumes cannot retrieve list of volumes. %v", err.Error())
+			return nil, apiErrorf(err, codes.Internal, "ListVolumes cannot retrieve list of volumes. %v", err.Error())
 		}
 		for i := range list {
 			entries = append(entries, &csi.ListVolumesResponse_Entry{
@@ -447,6 +666,10 @@ func (c *VultrControllerServer) ListVolumes(ctx context.Context, req *csi.ListVo
 					VolumeId:      list[i].ID,
 					CapacityBytes: int64(list[i].SizeGB) * giB,
 				},
+				Status: &csi.ListVolumesResponse_VolumeStatus{
+					PublishedNodeIds: publishedNodeIDs(&list[i]),
+					VolumeCondition:  volumeCondition(&list[i]),
+				},
 			})
 		}
 
@@ -457,18 +680,32 @@ func (c *VultrControllerServer) ListVolumes(ctx context.Context, req *csi.ListVo
 		break
 	}
 
+	if start > len(entries) {
+		return nil, status.Errorf(codes.Aborted, "ListVolumes starting_token %d is past the last of %d volumes", start, len(entries))
+	}
+
+	end := len(entries)
+	nextToken := ""
+	if req.MaxEntries > 0 && start+int(req.MaxEntries) < end {
+		end = start + int(req.MaxEntries)
+		nextToken = strconv.Itoa(end)
+	}
+
 	res := &csi.ListVolumesResponse{
-		Entries: entries,
+		Entries:   entries[start:end],
+		NextToken: nextToken,
 	}
 
-	c.Driver.log.WithFields(logrus.Fields{
-		"volumes": entries,
+	c.Driver.logger(ctx).WithFields(logrus.Fields{
+		"volumes":    res.Entries,
+		"next-token": nextToken,
 	}).Info("List Volumes")
 	return res, nil
 }
 
+// GetCapacity reports available capacity. The Vultr API does not expose remaining block storage capacity per region.
 func (c *VultrControllerServer) GetCapacity(context.Context, *csi.GetCapacityRequest) (*csi.GetCapacityResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+	return nil, status.Error(codes.Unimplemented, "GetCapacity is not supported, the Vultr API does not report available capacity")
 }
 
 // ControllerGetCapabilities get capabilities of the controller
@@ -484,12 +721,7 @@ func (c *VultrControllerServer) ControllerGetCapabilities(context.Context, *csi.
 	}
 
 	var capabilities []*csi.ControllerServiceCapability
-	for _, caps := range []csi.ControllerServiceCapability_RPC_Type{
-		csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
-		csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME,
-		csi.ControllerServiceCapability_RPC_LIST_VOLUMES,
-		csi.ControllerServiceCapability_RPC_EXPAND_VOLUME,
-	} {
+	for _, caps := range controllerCapabilities {
 		capabilities = append(capabilities, capability(caps))
 	}
 
@@ -505,58 +737,459 @@ func (c *VultrControllerServer) ControllerGetCapabilities(context.Context, *csi.
 	return resp, nil
 }
 
-// CreateSnapshot provides snapshot creation
+// CreateSnapshot provides snapshot creation. Vultr block storage does not support snapshots.
 func (c *VultrControllerServer) CreateSnapshot(context.Context, *csi.CreateSnapshotRequest) (*csi.CreateSnapshotResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+	return nil, status.Error(codes.Unimplemented, "CreateSnapshot is not supported, Vultr block storage has no snapshots")
 }
 
-// DeleteSnapshot provides snapshot deletion
+// DeleteSnapshot provides snapshot deletion. Vultr block storage does not support snapshots.
 func (c *VultrControllerServer) DeleteSnapshot(context.Context, *csi.DeleteSnapshotRequest) (*csi.DeleteSnapshotResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+	return nil, status.Error(codes.Unimplemented, "DeleteSnapshot is not supported, Vultr block storage has no snapshots")
 }
 
-// ListSnapshots provides the list snapshot
+// ListSnapshots provides the list snapshot. Vultr block storage does not support snapshots.
 func (c *VultrControllerServer) ListSnapshots(context.Context, *csi.ListSnapshotsRequest) (*csi.ListSnapshotsResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+	return nil, status.Error(codes.Unimplemented, "ListSnapshots is not supported, Vultr block storage has no snapshots")
 }
 
 // ControllerExpandVolume provides the expand volume
-func (c *VultrControllerServer) ControllerExpandVolume(ctx context.Context, req *csi.ControllerExpandVolumeRequest) (*csi.ControllerExpandVolumeResponse, error) { //nolint:lll
+func (c *VultrControllerServer) ControllerExpandVolume(ctx context.Context, req *csi.ControllerExpandVolumeRequest) (*csi.ControllerExpandVolumeResponse, error) { //nolint:lll,gocyclo
 	volumeID := req.GetVolumeId()
 	if volumeID == "" {
-		return nil, status.Error(codes.InvalidArgument, "NodeExpandVolume volume id must be provided")
+		return nil, status.Error(codes.InvalidArgument, "ControllerExpandVolume volume id must be provided")
 	}
 
-	if _, err := c.Driver.client.BlockStorage.Get(ctx, volumeID); err != nil {
-		return nil, status.Errorf(codes.Internal, "ControllerExpandVolume could not retrieve existing volume: %v", err)
+	if req.CapacityRange == nil {
+		return nil, status.Error(codes.InvalidArgument, "ControllerExpandVolume capacity range must be provided")
 	}
 
-	currentBlock, err := c.Driver.client.BlockStorage.Get(ctx, req.GetVolumeId())
+	if err := c.Driver.locks.TryAcquire(volumeID); err != nil {
+		return nil, err
+	}
+	defer c.Driver.locks.Release(volumeID)
+
+	currentBlock, err := c.Driver.client.BlockStorage.Get(ctx, volumeID)
 	if err != nil {
-		return nil, status.Errorf(codes.Internal, "%v", err)
+		return nil, apiErrorf(err, codes.NotFound, "ControllerExpandVolume could not retrieve existing volume: %v", err)
+	}
+
+	// volumes created before block types existed report none and are NVMe
+	blockType := currentBlock.BlockType
+	if blockType == "" {
+		blockType = blockTypeNvme
 	}
 
-	expanded := getStorageBytes(req.CapacityRange, currentBlock.BlockType)
+	expanded, err := getStorageBytes(req.CapacityRange, blockType, 0, true)
+	if err != nil {
+		return nil, err
+	}
+	sizeGB := int(expanded / giB)
 
-	c.Driver.log.WithFields(logrus.Fields{
-		"volume-id": req.VolumeId,
-		"size":      int(expanded / giB),
+	c.Driver.logger(ctx).WithFields(logrus.Fields{
+		"volume-id":    req.VolumeId,
+		"current-size": currentBlock.SizeGB,
+		"size":         sizeGB,
 	}).Info("Controller Expand Volume: called")
 
+	if sizeGB < currentBlock.SizeGB {
+		return nil, status.Errorf(codes.InvalidArgument,
+			"ControllerExpandVolume cannot shrink volume %s from %d GB to %d GB", volumeID, currentBlock.SizeGB, sizeGB)
+	}
+
+	// raw block volumes have no filesystem to grow on the node
+	nodeExpansionRequired := req.GetVolumeCapability().GetBlock() == nil
+
+	if sizeGB == currentBlock.SizeGB {
+		return &csi.ControllerExpandVolumeResponse{
+			CapacityBytes:         int64(currentBlock.SizeGB) * giB,
+			NodeExpansionRequired: nodeExpansionRequired,
+		}, nil
+	}
+
 	blockReq := &govultr.BlockStorageUpdate{
-		SizeGB: int(expanded / giB),
+		SizeGB: sizeGB,
+	}
+
+	if err := c.verifyVolume(ctx, "ControllerExpandVolume", verifyBefore, volumeID, volumeExists); err != nil {
+		return nil, err
 	}
 
 	if err := c.Driver.client.BlockStorage.Update(ctx, volumeID, blockReq); err != nil {
-		return nil, status.Errorf(codes.Internal, "cannot resize volume %s: %s", req.GetVolumeId(), err.Error())
+		return nil, apiErrorf(err, codes.Internal, "cannot resize volume %s: %s", req.GetVolumeId(), err.Error())
+	}
+
+	resized, err := c.waitForVolume(ctx, volumeID, "volume is not resized", func(bs *govultr.BlockStorage) bool {
+		return bs.SizeGB >= sizeGB
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.verifyVolume(ctx, "ControllerExpandVolume", verifyAfter, volumeID, volumeAtLeast(blockReq.SizeGB)); err != nil {
+		return nil, err
+	}
+
+	c.Driver.logger(ctx).WithFields(logrus.Fields{
+		"volume-id": req.VolumeId,
+		"size":      resized.SizeGB,
+	}).Info("Controller Expand Volume: expanded")
+
+	return &csi.ControllerExpandVolumeResponse{
+		CapacityBytes:         int64(resized.SizeGB) * giB,
+		NodeExpansionRequired: nodeExpansionRequired,
+	}, nil
+}
+
+// ControllerGetVolume reports the capacity, condition and published nodes of a single volume
+func (c *VultrControllerServer) ControllerGetVolume(ctx context.Context, req *csi.ControllerGetVolumeRequest) (*csi.ControllerGetVolumeResponse, error) { //nolint:lll
+	if req.VolumeId == "" {
+		return nil, status.Error(codes.InvalidArgument, "ControllerGetVolume Volume ID is missing")
+	}
+
+	volume, err := c.Driver.client.BlockStorage.Get(ctx, req.VolumeId)
+	if err != nil {
+		if isNotFound(err) {
+			return nil, status.Errorf(codes.NotFound, "volume %s not found: %v", req.VolumeId, err)
+		}
+		return nil, apiErrorf(err, codes.Internal, "cannot get volume: %v", err)
 	}
 
-	return &csi.ControllerExpandVolumeResponse{CapacityBytes: expanded, NodeExpansionRequired: false}, nil
+	return &csi.ControllerGetVolumeResponse{
+		Volume: &csi.Volume{
+			VolumeId:      volume.ID,
+			CapacityBytes: int64(volume.SizeGB) * giB,
+		},
+		Status: &csi.ControllerGetVolumeResponse_VolumeStatus{
+			PublishedNodeIds: publishedNodeIDs(volume),
+			VolumeCondition:  volumeCondition(volume),
+		},
+	}, nil
+}
+
+// publishedNodeIDs returns the node the volume is attached to, if any
+func publishedNodeIDs(volume *govultr.BlockStorage) []string {
+	if volume.AttachedToInstance == "" {
+		return nil
+	}
+	return []string{volume.AttachedToInstance}
+}
+
+// volumeCondition reports a volume as abnormal unless it is active
+func volumeCondition(volume *govultr.BlockStorage) *csi.VolumeCondition {
+	if volume.Status != "active" {
+		return &csi.VolumeCondition{
+			Abnormal: true,
+			Message:  fmt.Sprintf("volume status is %q", volume.Status),
+		}
+	}
+
+	return &csi.VolumeCondition{Message: "volume is active"}
+}
+
+// volumeLabel deterministically maps a CSI volume name to a Vultr label so a
+// retried CreateVolume finds the volume again. Valid names are used as is,
+// others have illegal characters stripped and are cut to length with a hash
+// of the full name appended to keep them unique.
+func volumeLabel(name string) string {
+	label := volumeLabelIllegalChars.ReplaceAllString(name, "")
+	if label == name && len(label) <= maxVolumeLabelLength {
+		return name
+	}
+
+	sum := sha256.Sum256([]byte(name))
+	suffix := hex.EncodeToString(sum[:])[:volumeLabelHashLength]
+
+	if limit := maxVolumeLabelLength - len(suffix) - 1; len(label) > limit {
+		label = label[:limit]
+	}
+
+	if label == "" {
+		return suffix
+	}
+	return label + "-" + suffix
+}
+
+// isCompatibleVolume checks that an existing volume satisfies a create request
+// for the same name, size is the capacity the request would be provisioned with
+func isCompatibleVolume(volume *govultr.BlockStorage, capRange *csi.CapacityRange, size int64, blockType string) error {
+	capacity := int64(volume.SizeGB) * giB
+
+	if capacity < size {
+		return fmt.Errorf("size of %d bytes is smaller than the requested %d bytes", capacity, size)
+	}
+
+	if limit := capRange.GetLimitBytes(); limit > 0 && capacity > limit {
+		return fmt.Errorf("size of %d bytes exceeds the limit of %d bytes", capacity, limit)
+	}
+
+	if volume.BlockType != "" && volume.BlockType != blockType {
+		return fmt.Errorf("block type %q differs from the requested %q", volume.BlockType, blockType)
+	}
+
+	return nil
+}
+
+// createInPreferredRegion creates the volume in the first region that has
+// capacity left, falling through the regions in order of preference
+func (c *VultrControllerServer) createInPreferredRegion(ctx context.Context, blockReq *govultr.BlockStorageCreate, regions []string) (*govultr.BlockStorage, error) { //nolint:lll
+	for i, region := range regions {
+		blockReq.Region = region
+
+		volume, err := c.Driver.client.BlockStorage.Create(ctx, blockReq)
+		if err == nil {
+			return volume, nil
+		}
+
+		if ctx.Err() != nil {
+			return nil, status.FromContextError(ctx.Err()).Err()
+		}
+
+		if !isRegionCapacityExhausted(err) {
+			return nil, apiErrorf(err, codes.Internal, "%v", err)
+		}
+
+		if i == len(regions)-1 {
+			return nil, status.Errorf(codes.ResourceExhausted,
+				"cannot create volume, no block storage capacity left in %v: %v", regions, err.Error())
+		}
+
+		c.Driver.logger(ctx).WithFields(logrus.Fields{
+			"volume-name": blockReq.Label,
+			"region":      region,
+			"next-region": regions[i+1],
+		}).Warn("Create Volume: region capacity exhausted, trying next region")
+	}
+
+	return nil, status.Error(codes.Internal, "cannot create volume, no region available")
+}
+
+// cloneVolumeError validates a volume content source and explains why it
+// cannot be cloned. The Vultr API has no way to copy block storage, so even a
+// valid source is refused rather than handing out a blank volume.
+func (c *VultrControllerServer) cloneVolumeError(ctx context.Context, sourceID string, requirements *csi.TopologyRequirement, size int64) error { //nolint:lll
+	source, err := c.Driver.client.BlockStorage.Get(ctx, sourceID)
+	if err != nil {
+		if isNotFound(err) {
+			return status.Errorf(codes.NotFound, "CreateVolume source volume %s not found", sourceID)
+		}
+		return apiErrorf(err, codes.Internal, "cannot get source volume %s: %v", sourceID, err)
+	}
+
+	regions, err := topologyRegions(requirements, c.Driver.region)
+	if err != nil {
+		return err
+	}
+
+	if !containsRegion(regions, source.Region) {
+		return status.Errorf(codes.InvalidArgument, "CreateVolume source volume %s is in region %s, the volume can only be created in %v",
+			sourceID, source.Region, regions)
+	}
+
+	if sourceSize := int64(source.SizeGB) * giB; sourceSize > size {
+		return status.Errorf(codes.OutOfRange, "CreateVolume source volume %s is %d bytes, larger than the requested %d bytes",
+			sourceID, sourceSize, size)
+	}
+
+	return status.Errorf(codes.InvalidArgument,
+		"CreateVolume cannot clone volume %s, Vultr block storage does not support copying volumes", sourceID)
+}
+
+// topologyRegions returns the regions allowed by the accessibility
+// requirements, preferred regions first. When requisite topologies are given
+// only regions among them are returned. The default region is used when the
+// requirements do not name any region. Topologies constrained by anything
+// other than the region cannot be satisfied by the driver.
+func topologyRegions(requirements *csi.TopologyRequirement, defaultRegion string) ([]string, error) {
+	requisite := map[string]bool{}
+	for _, topology := range requirements.GetRequisite() {
+		region, err := topologyRegion(topology)
+		if err != nil {
+			return nil, err
+		}
+		requisite[region] = true
+	}
+
+	var regions []string
+	seen := map[string]bool{}
+
+	for _, topology := range append(requirements.GetPreferred(), requirements.GetRequisite()...) {
+		region, err := topologyRegion(topology)
+		if err != nil {
+			return nil, err
+		}
+
+		if seen[region] || (len(requisite) > 0 && !requisite[region]) {
+			continue
+		}
+
+		seen[region] = true
+		regions = append(regions, region)
+	}
+
+	if len(regions) == 0 {
+		return []string{defaultRegion}, nil
+	}
+
+	return regions, nil
+}
+
+// topologyRegion returns the region of a topology that only has a region segment
+func topologyRegion(topology *csi.Topology) (string, error) {
+	segments := topology.GetSegments()
+	region := segments["region"]
+
+	if region == "" || len(segments) != 1 {
+		return "", status.Errorf(codes.ResourceExhausted, "topology %v cannot be satisfied, only a region segment is supported", segments)
+	}
+
+	return region, nil
+}
+
+// isRegionCapacityExhausted reports whether block storage creation failed
+// because the region has no capacity left
+func isRegionCapacityExhausted(err error) bool {
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "out of stock") || strings.Contains(msg, "insufficient capacity")
+}
+
+// waitForVolume polls the volume until ready reports true, doubling the
+// interval between polls up to the configured maximum. It gives up with the
+// not ready message once the retries are used up, or earlier when the
+// context is done.
+func (c *VultrControllerServer) waitForVolume(ctx context.Context, volumeID, notReady string, ready func(*govultr.BlockStorage) bool) (*govultr.BlockStorage, error) { //nolint:lll
+	interval := c.Driver.statusCheckInterval
+	for i := 0; i < c.Driver.statusCheckRetries; i++ {
+		select {
+		case <-ctx.Done():
+			return nil, status.FromContextError(ctx.Err()).Err()
+		case <-time.After(interval):
+		}
+
+		interval *= 2
+		if interval > c.Driver.statusCheckMaxInterval {
+			interval = c.Driver.statusCheckMaxInterval
+		}
+
+		bs, err := c.Driver.client.BlockStorage.Get(ctx, volumeID)
+		if err != nil {
+			return nil, apiErrorf(err, codes.Internal, "%v", err)
+		}
+
+		if ready(bs) {
+			return bs, nil
+		}
+
+		c.Driver.logger(ctx).WithFields(logrus.Fields{
+			"volume-id":          volumeID,
+			"volume-status":      bs.Status,
+			"attached-to":        bs.AttachedToInstance,
+			"size-gb":            bs.SizeGB,
+			"status-check":       i + 1,
+			"status-check-limit": c.Driver.statusCheckRetries,
+		}).Debug("waiting on volume: " + notReady)
+	}
+
+	c.Driver.logger(ctx).WithFields(logrus.Fields{
+		"volume-id":    volumeID,
+		"status-check": c.Driver.statusCheckRetries,
+	}).Warn("gave up waiting on volume: " + notReady)
+	return nil, status.Errorf(codes.Internal, "%s after %d status checks", notReady, c.Driver.statusCheckRetries)
+}
+
+// attachedVolumeCount returns the number of volumes attached to the node
+func (c *VultrControllerServer) attachedVolumeCount(ctx context.Context, nodeID string) (int, error) {
+	listOptions := &govultr.ListOptions{}
+	count := 0
+	for {
+		list, meta, err := c.Driver.client.BlockStorage.List(ctx, listOptions)
+		if err != nil {
+			return 0, apiErrorf(err, codes.Internal, "cannot list volumes attached to node %s: %v", nodeID, err)
+		}
+
+		for i := range list {
+			if list[i].AttachedToInstance == nodeID {
+				count++
+			}
+		}
+
+		if meta.Links.Next != "" {
+			listOptions.Cursor = meta.Links.Next
+			continue
+		}
+
+		return count, nil
+	}
+}
+
+// detachFromStoppedNode detaches a volume from a node so it can be attached
+// elsewhere. A node that is still running may be writing to the volume, so it
+// is only detached from a node that is powered off or no longer exists.
+func (c *VultrControllerServer) detachFromStoppedNode(ctx context.Context, volumeID, nodeID string) error {
+	instance, err := c.Driver.client.Instance.Get(ctx, nodeID)
+	if err != nil && !isNotFound(err) {
+		return status.Errorf(codes.Internal, "cannot get node %s the volume is attached to: %v", nodeID, err)
+	}
+
+	if err == nil && instance.PowerStatus == instancePowerRunning {
+		return status.Errorf(codes.FailedPrecondition,
+			"cannot force detach volume %s from node %s, the node is still running and may be using it", volumeID, nodeID)
+	}
+
+	c.Driver.logger(ctx).WithFields(logrus.Fields{
+		"volume-id": volumeID,
+		"node-id":   nodeID,
+	}).Warn("Controller Publish Volume: force detaching volume from stopped node")
+
+	err = c.Driver.client.BlockStorage.Detach(ctx, volumeID, &govultr.BlockStorageDetach{Live: govultr.BoolToBoolPtr(true)})
+	if err != nil && !strings.Contains(err.Error(), "Block storage volume is not currently attached to a server") {
+		return apiErrorf(err, codes.Internal, "cannot detach volume from node %s: %v", nodeID, err)
+	}
+
+	_, err = c.waitForVolume(ctx, volumeID, "volume is not detached from node", func(bs *govultr.BlockStorage) bool {
+		return bs.AttachedToInstance != nodeID
+	})
+	return err
+}
+
+// attachVolume attaches the volume, retrying with backoff while the instance
+// is locked by another operation
+func (c *VultrControllerServer) attachVolume(ctx context.Context, volumeID string, attach *govultr.BlockStorageAttach) error {
+	interval := c.Driver.statusCheckInterval
+	for i := 1; ; i++ {
+		err := c.Driver.client.BlockStorage.Attach(ctx, volumeID, attach)
+		if err == nil || !isInstanceLocked(err) || i >= volumeAttachRetries {
+			return err
+		}
+
+		c.Driver.logger(ctx).WithFields(logrus.Fields{
+			"volume-id": volumeID,
+			"node-id":   attach.InstanceID,
+			"attempt":   i,
+		}).Warn("Controller Publish Volume: instance is locked, retrying attach")
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(interval):
+		}
+
+		interval *= 2
+		if interval > c.Driver.statusCheckMaxInterval {
+			interval = c.Driver.statusCheckMaxInterval
+		}
+	}
+}
+
+// isNotFound reports whether the Vultr API could not find the resource
+func isNotFound(err error) bool {
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, `"status":404`) || strings.Contains(msg, "not found")
 }
 
-// ControllerGetVolume This relates to being able to get health checks on a PV. We do not have this
-func (c *VultrControllerServer) ControllerGetVolume(ctx context.Context, request *csi.ControllerGetVolumeRequest) (*csi.ControllerGetVolumeResponse, error) { //nolint:lll
-	return nil, status.Error(codes.Unimplemented, "")
+// isInstanceLocked reports whether the error is due to another operation
+// being in flight on the instance
+func isInstanceLocked(err error) bool {
+	return strings.Contains(err.Error(), "Server is currently locked")
 }
 
 func isValidCapability(caps []*csi.VolumeCapability) bool {
@@ -570,7 +1203,7 @@ func isValidCapability(caps []*csi.VolumeCapability) bool {
 			return false
 		}
 
-		if accessMode.GetMode() != supportedVolCapabilities.GetMode() {
+		if !isSupportedAccessMode(accessMode.GetMode()) {
 			return false
 		}
 
@@ -585,15 +1218,112 @@ func isValidCapability(caps []*csi.VolumeCapability) bool {
 	return true
 }
 
-// getStorageBytes returns storage size in bytes
-func getStorageBytes(capRange *csi.CapacityRange, blockType string) int64 {
-	// Default for HDD block is 40gb, NVME block is 10gb
-	if capRange == nil && blockType == blockTypeNvme {
-		return nvmeVolumeSizeInBytes
-	} else if capRange == nil && blockType == blockTypeHDD {
-		return hddDefaultVolumeSizeInBytes
+func containsRegion(regions []string, region string) bool {
+	for _, r := range regions {
+		if r == region {
+			return true
+		}
+	}
+	return false
+}
+
+func isSupportedAccessMode(mode csi.VolumeCapability_AccessMode_Mode) bool {
+	for _, supported := range supportedAccessModes {
+		if mode == supported {
+			return true
+		}
+	}
+	return false
+}
+
+func isSupportedBlockType(blockType string) bool {
+	for _, supported := range supportedBlockTypes {
+		if blockType == supported {
+			return true
+		}
 	}
+	return false
+}
 
-	capacity := capRange.GetRequiredBytes()
-	return capacity
+func isSupportedFsType(fsType string) bool {
+	for _, supported := range supportedFsTypes {
+		if fsType == supported {
+			return true
+		}
+	}
+	return false
+}
+
+// getStorageBytes returns storage size in bytes for the block type, rounded
+// up to whole GiB as block storage is only allocated in whole GB. A limit on
+// its own provisions the largest whole GiB size under it. Requests below the
+// block type minimum are raised to it, requests that cannot fit within the
+// block type maximum or the limit are out of range. Without a size the
+// volume gets defaultSize, or the block type default when it is zero, unless
+// requireCapacity is set.
+func getStorageBytes(capRange *csi.CapacityRange, blockType string, defaultSize int64, requireCapacity bool) (int64, error) {
+	blockTypeDefault, minSize, maxSize, err := blockTypeSizes(blockType)
+	if err != nil {
+		return 0, err
+	}
+
+	if defaultSize == 0 {
+		defaultSize = blockTypeDefault
+	}
+
+	required := capRange.GetRequiredBytes()
+	limit := capRange.GetLimitBytes()
+
+	if required < 0 || limit < 0 {
+		return 0, status.Errorf(codes.InvalidArgument, "capacity range must not be negative, required %d bytes, limit %d bytes", required, limit)
+	}
+
+	// checked before rounding, which would overflow for sizes close to MaxInt64
+	if required > maxSize {
+		return 0, status.Errorf(codes.OutOfRange, "required size of %d bytes exceeds the %s maximum of %d bytes", required, blockType, maxSize)
+	}
+
+	if required == 0 && limit == 0 && requireCapacity {
+		return 0, status.Error(codes.InvalidArgument, "a capacity range is required, volumes are not created with a default size")
+	}
+
+	if limit > 0 && required > limit {
+		return 0, status.Errorf(codes.OutOfRange, "required size of %d bytes exceeds the limit of %d bytes", required, limit)
+	}
+
+	var capacity int64
+	switch {
+	case required > 0:
+		capacity = (required + giB - 1) / giB * giB
+	case limit > 0:
+		capacity = limit / giB * giB
+	default:
+		capacity = defaultSize
+	}
+
+	if capacity < minSize {
+		capacity = minSize
+	}
+
+	if capacity > maxSize {
+		return 0, status.Errorf(codes.OutOfRange, "requested size of %d bytes exceeds the %s maximum of %d bytes", capacity, blockType, maxSize)
+	}
+
+	if limit > 0 && capacity > limit {
+		return 0, status.Errorf(codes.OutOfRange, "size of %d bytes does not fit within the limit of %d bytes", capacity, limit)
+	}
+
+	return capacity, nil
+}
+
+// blockTypeSizes returns the default, minimum and maximum size in bytes for the block type
+func blockTypeSizes(blockType string) (defaultSize, minSize, maxSize int64, err error) {
+	switch blockType {
+	case blockTypeNvme:
+		return nvmeVolumeSizeInBytes, nvmeMinVolumeSizeInBytes, nvmeMaxVolumeSizeInBytes, nil
+	case blockTypeHDD:
+		return hddDefaultVolumeSizeInBytes, hddMinVolumeSizeInBytes, hddMaxVolumeSizeInBytes, nil
+	default:
+		return 0, 0, 0, status.Errorf(codes.InvalidArgument, "unknown block type %q", blockType)
+	}
 }
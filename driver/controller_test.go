@@ -2,11 +2,20 @@ package driver
 
 import (
 	"context"
+	"errors"
+	"math"
 	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/sirupsen/logrus"
+	"github.com/vultr/govultr/v2"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 func NewFakeVultrControllerServer(testName string) *VultrControllerServer {
@@ -21,6 +30,15 @@ func NewFakeVultrControllerServer(testName string) *VultrControllerServer {
 		log:             log,
 		region:          "ewr",
 		publishVolumeID: "c56c7b6e-15c2-445e-9a5d-1063ab5828ec",
+		history:         newOperationHistory(),
+		locks:           newVolumeLocks(),
+		nodeLocks:       newNodeLocks(),
+
+		statusCheckRetries:     DefaultVolumeStatusCheckRetries,
+		statusCheckInterval:    time.Millisecond,
+		statusCheckMaxInterval: 10 * time.Millisecond,
+
+		maxVolumesPerNode: DefaultMaxVolumesPerNode,
 	}
 
 	return NewVultrControllerServer(d)
@@ -140,3 +158,1849 @@ func TestUnPublishVolume(t *testing.T) {
 		t.Errorf("expected %+v got %+v", res, expected)
 	}
 }
+
+// detachedBS reports the volume as detached until it is attached. The first
+// lockedAttempts attach calls fail with an instance locked error, after which
+// attachErr is returned when set.
+type detachedBS struct {
+	fakeBS
+	lockedAttempts int
+	attachErr      error
+	attachedTo     string
+}
+
+func (f *detachedBS) Get(ctx context.Context, blockID string) (*govultr.BlockStorage, error) {
+	bs := newFakeBS()
+	bs.AttachedToInstance = f.attachedTo
+	return bs, nil
+}
+
+func (f *detachedBS) Attach(ctx context.Context, blockID string, attach *govultr.BlockStorageAttach) error {
+	if f.lockedAttempts > 0 {
+		f.lockedAttempts--
+		return errors.New(`{"error":"Server is currently locked","status":400}`)
+	}
+
+	if f.attachErr != nil {
+		return f.attachErr
+	}
+
+	f.attachedTo = attach.InstanceID
+	return nil
+}
+
+func TestPublishVolumeInstanceLocked(t *testing.T) {
+	controller := NewFakeVultrControllerServer("publish volume instance locked")
+	bs := &detachedBS{lockedAttempts: 1}
+	controller.Driver.client.BlockStorage = bs
+
+	nodeID := "245bb2fe-b55c-44a0-9a1e-ab80e4b5f088"
+	volumeID := "c56c7b6e-15c2-445e-9a5d-1063ab5828ec"
+
+	res, err := controller.ControllerPublishVolume(context.Background(), &csi.ControllerPublishVolumeRequest{
+		NodeId:   nodeID,
+		VolumeId: volumeID,
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{
+				Mount: &csi.VolumeCapability_MountVolume{},
+			},
+			AccessMode: &csi.VolumeCapability_AccessMode{
+				Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+			},
+		},
+	})
+
+	if err != nil {
+		t.Errorf("Expected no error, got error : %v", err)
+	}
+
+	if bs.lockedAttempts != 0 || bs.attachedTo != nodeID {
+		t.Errorf("expected volume to be attached to %s after retry, got %q", nodeID, bs.attachedTo)
+	}
+
+	expected := &csi.ControllerPublishVolumeResponse{
+		PublishContext: map[string]string{
+			controller.Driver.publishVolumeID: volumeID,
+		},
+	}
+
+	if !reflect.DeepEqual(res, expected) {
+		t.Errorf("expected %+v got %+v", res, expected)
+	}
+}
+
+func TestPublishVolumeInstanceStaysLocked(t *testing.T) {
+	controller := NewFakeVultrControllerServer("publish volume instance stays locked")
+	bs := &detachedBS{lockedAttempts: 100}
+	controller.Driver.client.BlockStorage = bs
+
+	_, err := controller.ControllerPublishVolume(context.Background(), &csi.ControllerPublishVolumeRequest{
+		NodeId:   "245bb2fe-b55c-44a0-9a1e-ab80e4b5f088",
+		VolumeId: "c56c7b6e-15c2-445e-9a5d-1063ab5828ec",
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{
+				Mount: &csi.VolumeCapability_MountVolume{},
+			},
+			AccessMode: &csi.VolumeCapability_AccessMode{
+				Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+			},
+		},
+	})
+
+	if status.Code(err) != codes.Aborted {
+		t.Errorf("expected %v got %v", codes.Aborted, err)
+	}
+
+	if attempts := 100 - bs.lockedAttempts; attempts != volumeAttachRetries {
+		t.Errorf("expected %d attach attempts, got %d", volumeAttachRetries, attempts)
+	}
+}
+
+func TestCreateVolumeStrictIdempotency(t *testing.T) {
+	controller := NewFakeVultrControllerServer("create volume strict idempotency")
+	controller.Driver.strictIdempotency = true
+
+	// the fake client always reads back a volume labeled "test-bs"
+	_, err := controller.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:       "volume-test-name",
+		Parameters: map[string]string{"block_type": "high_perf"},
+		VolumeCapabilities: []*csi.VolumeCapability{
+			{
+				AccessType: &csi.VolumeCapability_Mount{
+					Mount: &csi.VolumeCapability_MountVolume{},
+				},
+				AccessMode: &csi.VolumeCapability_AccessMode{
+					Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+				},
+			},
+		},
+	})
+
+	if status.Code(err) != codes.Internal {
+		t.Errorf("expected %v got %v", codes.Internal, err)
+	}
+}
+
+// movingBS reports the volume attached to each node of attachedTo in turn,
+// the last one is repeated once the others are used up
+type movingBS struct {
+	fakeBS
+	attachedTo []string
+	detaches   int
+}
+
+func (f *movingBS) Get(ctx context.Context, blockID string) (*govultr.BlockStorage, error) {
+	bs := newFakeBS()
+	bs.AttachedToInstance = f.attachedTo[0]
+	if len(f.attachedTo) > 1 {
+		f.attachedTo = f.attachedTo[1:]
+	}
+	return bs, nil
+}
+
+func (f *movingBS) Detach(ctx context.Context, blockID string, detach *govultr.BlockStorageDetach) error {
+	f.detaches++
+	return nil
+}
+
+func TestVolumeDeleted(t *testing.T) {
+	tests := []struct {
+		name    string
+		bs      *govultr.BlockStorage
+		err     error
+		deleted bool
+	}{
+		{
+			name: "still exists",
+			bs:   newFakeBS(),
+		},
+		{
+			name:    "not found",
+			err:     errors.New(`{"error":"Invalid block storage ID","status":404}`),
+			deleted: true,
+		},
+		{
+			name: "unauthorized",
+			err:  errors.New(`{"error":"Invalid API token.","status":401}`),
+		},
+		{
+			name: "server error",
+			err:  errors.New(`{"error":"Internal server error","status":500}`),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := volumeDeleted(tt.bs, tt.err)
+			if (err == nil) != tt.deleted {
+				t.Errorf("expected deleted %v, got error %v", tt.deleted, err)
+			}
+		})
+	}
+}
+
+func TestUnPublishVolumeStrictIdempotency(t *testing.T) {
+	controller := NewFakeVultrControllerServer("unpublish volume strict idempotency")
+	controller.Driver.strictIdempotency = true
+
+	// the volume moves to another node between the lookup and the check
+	bs := &movingBS{attachedTo: []string{"94cf529e-796c-44c0-8a18-6e0be753f155", "245bb2fe-b55c-44a0-9a1e-ab80e4b5f088"}}
+	controller.Driver.client.BlockStorage = bs
+
+	_, err := controller.ControllerUnpublishVolume(context.Background(), &csi.ControllerUnpublishVolumeRequest{
+		NodeId:   "94cf529e-796c-44c0-8a18-6e0be753f155",
+		VolumeId: "c56c7b6e-15c2-445e-9a5d-1063ab5828ec",
+	})
+
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("expected %v got %v", codes.FailedPrecondition, err)
+	}
+
+	if bs.detaches != 0 {
+		t.Errorf("expected no detach, got %d", bs.detaches)
+	}
+}
+
+func TestUnPublishVolumeOtherNode(t *testing.T) {
+	controller := NewFakeVultrControllerServer("unpublish volume other node")
+
+	// a late unpublish for the old node after the volume was published elsewhere
+	bs := &movingBS{attachedTo: []string{"245bb2fe-b55c-44a0-9a1e-ab80e4b5f088"}}
+	controller.Driver.client.BlockStorage = bs
+
+	_, err := controller.ControllerUnpublishVolume(context.Background(), &csi.ControllerUnpublishVolumeRequest{
+		NodeId:   "b9d23eb3-1880-4746-acc7-f1ef56565320",
+		VolumeId: "c56c7b6e-15c2-445e-9a5d-1063ab5828ec",
+	})
+
+	if err != nil {
+		t.Errorf("Expected no error, got error : %v", err)
+	}
+
+	if bs.detaches != 0 {
+		t.Errorf("expected the volume not to be detached from its new node, got %d detaches", bs.detaches)
+	}
+}
+
+// getErrorBS fails every volume lookup with err
+type getErrorBS struct {
+	fakeBS
+	err error
+}
+
+func (f *getErrorBS) Get(ctx context.Context, blockID string) (*govultr.BlockStorage, error) {
+	return nil, f.err
+}
+
+func TestUnPublishVolumeGetErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		code codes.Code
+	}{
+		{
+			name: "not found",
+			err:  errors.New(`{"error":"Invalid block storage ID","status":404}`),
+			code: codes.OK,
+		},
+		{
+			name: "unauthorized",
+			err:  errors.New(`{"error":"Invalid API token.","status":401}`),
+			code: codes.Internal,
+		},
+		{
+			name: "rate limited",
+			err:  status.Error(codes.ResourceExhausted, "Vultr API rate limit exceeded"),
+			code: codes.ResourceExhausted,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			controller := NewFakeVultrControllerServer("unpublish volume " + tt.name)
+			controller.Driver.client.BlockStorage = &getErrorBS{err: tt.err}
+
+			_, err := controller.ControllerUnpublishVolume(context.Background(), &csi.ControllerUnpublishVolumeRequest{
+				NodeId:   "245bb2fe-b55c-44a0-9a1e-ab80e4b5f088",
+				VolumeId: "c56c7b6e-15c2-445e-9a5d-1063ab5828ec",
+			})
+
+			if status.Code(err) != tt.code {
+				t.Errorf("expected %v got %v", tt.code, err)
+			}
+		})
+	}
+}
+
+// exhaustedBS fails block storage creation in the exhausted regions
+type exhaustedBS struct {
+	fakeBS
+	exhausted map[string]bool
+}
+
+func (f *exhaustedBS) Create(ctx context.Context, blockReq *govultr.BlockStorageCreate) (*govultr.BlockStorage, error) {
+	if f.exhausted[blockReq.Region] {
+		return nil, errors.New(`{"error":"Block storage is out of stock in this region","status":400}`)
+	}
+
+	bs := newFakeBS()
+	bs.Region = blockReq.Region
+	return bs, nil
+}
+
+func TestCreateVolumeRegionExhausted(t *testing.T) {
+	controller := NewFakeVultrControllerServer("create volume region exhausted")
+	controller.Driver.client.BlockStorage = &exhaustedBS{exhausted: map[string]bool{"ewr": true}}
+
+	req := &csi.CreateVolumeRequest{
+		Name:       "volume-test-name",
+		Parameters: map[string]string{"block_type": "high_perf"},
+		VolumeCapabilities: []*csi.VolumeCapability{
+			{
+				AccessType: &csi.VolumeCapability_Mount{
+					Mount: &csi.VolumeCapability_MountVolume{},
+				},
+				AccessMode: &csi.VolumeCapability_AccessMode{
+					Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+				},
+			},
+		},
+		AccessibilityRequirements: &csi.TopologyRequirement{
+			Preferred: []*csi.Topology{
+				{Segments: map[string]string{"region": "ewr"}},
+				{Segments: map[string]string{"region": "lax"}},
+			},
+		},
+	}
+
+	res, err := controller.CreateVolume(context.Background(), req)
+	if err != nil {
+		t.Fatalf("Expected no error, got error : %v", err)
+	}
+
+	expected := []*csi.Topology{
+		{
+			Segments: map[string]string{
+				"region": "lax",
+			},
+		},
+	}
+
+	if !reflect.DeepEqual(res.Volume.AccessibleTopology, expected) {
+		t.Errorf("expected %+v got %+v", expected, res.Volume.AccessibleTopology)
+	}
+
+	req.AccessibilityRequirements = nil
+	_, err = controller.CreateVolume(context.Background(), req)
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("expected %v got %v", codes.ResourceExhausted, err)
+	}
+}
+
+func TestPublishVolumeAttachError(t *testing.T) {
+	controller := NewFakeVultrControllerServer("publish volume attach error")
+	controller.Driver.client.BlockStorage = &detachedBS{attachErr: errors.New(`{"error":"Unable to attach volume","status":500}`)}
+
+	_, err := controller.ControllerPublishVolume(context.Background(), &csi.ControllerPublishVolumeRequest{
+		NodeId:   "245bb2fe-b55c-44a0-9a1e-ab80e4b5f088",
+		VolumeId: "c56c7b6e-15c2-445e-9a5d-1063ab5828ec",
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{
+				Mount: &csi.VolumeCapability_MountVolume{},
+			},
+			AccessMode: &csi.VolumeCapability_AccessMode{
+				Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+			},
+		},
+	})
+
+	if status.Code(err) != codes.Internal {
+		t.Errorf("expected %v got %v", codes.Internal, err)
+	}
+}
+
+func TestUnPublishVolumeDeadline(t *testing.T) {
+	controller := NewFakeVultrControllerServer("unpublish volume deadline")
+	controller.Driver.statusCheckRetries = 1000
+	// the volume never reports as detached
+	controller.Driver.client.BlockStorage = &detachedBS{attachedTo: "245bb2fe-b55c-44a0-9a1e-ab80e4b5f088"}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	_, err := controller.ControllerUnpublishVolume(ctx, &csi.ControllerUnpublishVolumeRequest{
+		NodeId:   "245bb2fe-b55c-44a0-9a1e-ab80e4b5f088",
+		VolumeId: "c56c7b6e-15c2-445e-9a5d-1063ab5828ec",
+	})
+
+	if status.Code(err) != codes.DeadlineExceeded {
+		t.Errorf("expected %v got %v", codes.DeadlineExceeded, err)
+	}
+}
+
+func TestExpandVolume(t *testing.T) {
+	controller := NewFakeVultrControllerServer("expand volume")
+
+	volumeID := "c56c7b6e-15c2-445e-9a5d-1063ab5828ec"
+	res, err := controller.ControllerExpandVolume(context.Background(), &csi.ControllerExpandVolumeRequest{
+		VolumeId: volumeID,
+		CapacityRange: &csi.CapacityRange{
+			RequiredBytes: 20*giB + 1,
+		},
+	})
+
+	if err != nil {
+		t.Fatalf("Expected no error, got error : %v", err)
+	}
+
+	expected := &csi.ControllerExpandVolumeResponse{
+		CapacityBytes:         21 * giB,
+		NodeExpansionRequired: true,
+	}
+
+	if !reflect.DeepEqual(res, expected) {
+		t.Errorf("expected %+v got %+v", expected, res)
+	}
+}
+
+func TestExpandVolumeWithoutBlockType(t *testing.T) {
+	controller := NewFakeVultrControllerServer("expand volume without block type")
+
+	volumeID := "c56c7b6e-15c2-445e-9a5d-1063ab5828ec"
+	volume, err := controller.Driver.client.BlockStorage.Get(context.Background(), volumeID)
+	if err != nil {
+		t.Fatalf("Expected no error, got error : %v", err)
+	}
+
+	if volume.BlockType != "" {
+		t.Fatalf("expected a volume without a block type, got %q", volume.BlockType)
+	}
+
+	res, err := controller.ControllerExpandVolume(context.Background(), &csi.ControllerExpandVolumeRequest{
+		VolumeId: volumeID,
+		CapacityRange: &csi.CapacityRange{
+			RequiredBytes: 20 * giB,
+		},
+	})
+
+	if err != nil {
+		t.Fatalf("Expected no error, got error : %v", err)
+	}
+
+	if res.CapacityBytes != 20*giB {
+		t.Errorf("expected %d bytes got %d", 20*giB, res.CapacityBytes)
+	}
+
+	// the NVMe limits apply to volumes without a block type
+	_, err = controller.ControllerExpandVolume(context.Background(), &csi.ControllerExpandVolumeRequest{
+		VolumeId: volumeID,
+		CapacityRange: &csi.CapacityRange{
+			RequiredBytes: nvmeMaxVolumeSizeInBytes + giB,
+		},
+	})
+
+	if status.Code(err) != codes.OutOfRange {
+		t.Errorf("expected %v got %v", codes.OutOfRange, err)
+	}
+}
+
+func TestExpandVolumeShrink(t *testing.T) {
+	controller := NewFakeVultrControllerServer("expand volume shrink")
+
+	volumeID := "c56c7b6e-15c2-445e-9a5d-1063ab5828ec"
+	err := controller.Driver.client.BlockStorage.Update(context.Background(), volumeID, &govultr.BlockStorageUpdate{SizeGB: 30})
+	if err != nil {
+		t.Fatalf("Expected no error, got error : %v", err)
+	}
+
+	_, err = controller.ControllerExpandVolume(context.Background(), &csi.ControllerExpandVolumeRequest{
+		VolumeId: volumeID,
+		CapacityRange: &csi.CapacityRange{
+			RequiredBytes: 20 * giB,
+		},
+	})
+
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected %v got %v", codes.InvalidArgument, err)
+	}
+}
+
+func TestCreateVolumeFromSnapshot(t *testing.T) {
+	controller := NewFakeVultrControllerServer("create volume from snapshot")
+
+	_, err := controller.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:       "volume-test-name",
+		Parameters: map[string]string{"block_type": "high_perf"},
+		VolumeCapabilities: []*csi.VolumeCapability{
+			{
+				AccessType: &csi.VolumeCapability_Mount{
+					Mount: &csi.VolumeCapability_MountVolume{},
+				},
+				AccessMode: &csi.VolumeCapability_AccessMode{
+					Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+				},
+			},
+		},
+		VolumeContentSource: &csi.VolumeContentSource{
+			Type: &csi.VolumeContentSource_Snapshot{
+				Snapshot: &csi.VolumeContentSource_SnapshotSource{
+					SnapshotId: "snapshot-id",
+				},
+			},
+		},
+	})
+
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected %v got %v", codes.InvalidArgument, err)
+	}
+}
+
+func TestCreateVolumeFromVolume(t *testing.T) {
+	tests := []struct {
+		name         string
+		bs           govultr.BlockStorageService
+		requirements *csi.TopologyRequirement
+		capacity     int64
+		code         codes.Code
+	}{
+		{
+			name: "source not found",
+			bs:   &missingBS{},
+			code: codes.NotFound,
+		},
+		{
+			name: "source in another region",
+			bs:   &fakeBS{},
+			requirements: &csi.TopologyRequirement{
+				Requisite: []*csi.Topology{{Segments: map[string]string{"region": "lax"}}},
+			},
+			code: codes.InvalidArgument,
+		},
+		{
+			name:     "source larger than the volume",
+			bs:       &fakeBS{resized: map[string]int{"c56c7b6e-15c2-445e-9a5d-1063ab5828ec": 20}},
+			capacity: 10 * giB,
+			code:     codes.OutOfRange,
+		},
+		{
+			name: "clone not supported",
+			bs:   &fakeBS{},
+			code: codes.InvalidArgument,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			controller := NewFakeVultrControllerServer("create volume from volume")
+			controller.Driver.client.BlockStorage = tt.bs
+
+			req := &csi.CreateVolumeRequest{
+				Name: "volume-test-name",
+				VolumeCapabilities: []*csi.VolumeCapability{
+					{
+						AccessType: &csi.VolumeCapability_Mount{
+							Mount: &csi.VolumeCapability_MountVolume{},
+						},
+						AccessMode: &csi.VolumeCapability_AccessMode{
+							Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+						},
+					},
+				},
+				AccessibilityRequirements: tt.requirements,
+				VolumeContentSource: &csi.VolumeContentSource{
+					Type: &csi.VolumeContentSource_Volume{
+						Volume: &csi.VolumeContentSource_VolumeSource{
+							VolumeId: "c56c7b6e-15c2-445e-9a5d-1063ab5828ec",
+						},
+					},
+				},
+			}
+			if tt.capacity != 0 {
+				req.CapacityRange = &csi.CapacityRange{RequiredBytes: tt.capacity}
+			}
+
+			_, err := controller.CreateVolume(context.Background(), req)
+			if status.Code(err) != tt.code {
+				t.Errorf("expected %v got %v", tt.code, err)
+			}
+		})
+	}
+}
+
+func TestControllerGetCapabilities(t *testing.T) {
+	controller := NewFakeVultrControllerServer("controller get capabilities")
+	ctx := context.Background()
+
+	// each probe calls the RPC behind a capability with an empty request, an
+	// implemented RPC rejects it as invalid instead of returning Unimplemented
+	probes := map[csi.ControllerServiceCapability_RPC_Type]func() error{
+		csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME: func() error {
+			_, err := controller.DeleteVolume(ctx, &csi.DeleteVolumeRequest{})
+			return err
+		},
+		csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME: func() error {
+			_, err := controller.ControllerUnpublishVolume(ctx, &csi.ControllerUnpublishVolumeRequest{})
+			return err
+		},
+		csi.ControllerServiceCapability_RPC_LIST_VOLUMES: func() error {
+			_, err := controller.ListVolumes(ctx, &csi.ListVolumesRequest{})
+			return err
+		},
+		csi.ControllerServiceCapability_RPC_LIST_VOLUMES_PUBLISHED_NODES: func() error {
+			_, err := controller.ListVolumes(ctx, &csi.ListVolumesRequest{})
+			return err
+		},
+		csi.ControllerServiceCapability_RPC_GET_CAPACITY: func() error {
+			_, err := controller.GetCapacity(ctx, &csi.GetCapacityRequest{})
+			return err
+		},
+		csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT: func() error {
+			_, err := controller.DeleteSnapshot(ctx, &csi.DeleteSnapshotRequest{})
+			return err
+		},
+		csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS: func() error {
+			_, err := controller.ListSnapshots(ctx, &csi.ListSnapshotsRequest{})
+			return err
+		},
+		csi.ControllerServiceCapability_RPC_EXPAND_VOLUME: func() error {
+			_, err := controller.ControllerExpandVolume(ctx, &csi.ControllerExpandVolumeRequest{})
+			return err
+		},
+		csi.ControllerServiceCapability_RPC_GET_VOLUME: func() error {
+			_, err := controller.ControllerGetVolume(ctx, &csi.ControllerGetVolumeRequest{})
+			return err
+		},
+		csi.ControllerServiceCapability_RPC_VOLUME_CONDITION: func() error {
+			_, err := controller.ControllerGetVolume(ctx, &csi.ControllerGetVolumeRequest{})
+			return err
+		},
+		csi.ControllerServiceCapability_RPC_SINGLE_NODE_MULTI_WRITER: func() error {
+			_, err := controller.ValidateVolumeCapabilities(ctx, &csi.ValidateVolumeCapabilitiesRequest{})
+			return err
+		},
+	}
+
+	res, err := controller.ControllerGetCapabilities(ctx, &csi.ControllerGetCapabilitiesRequest{})
+	if err != nil {
+		t.Fatalf("Expected no error, got error : %v", err)
+	}
+
+	advertised := map[csi.ControllerServiceCapability_RPC_Type]bool{}
+	for _, capability := range res.Capabilities {
+		rpc := capability.GetRpc().GetType()
+		if _, ok := probes[rpc]; !ok {
+			t.Errorf("capability %v is advertised but has no probe", rpc)
+		}
+		advertised[rpc] = true
+	}
+
+	for rpc, probe := range probes {
+		implemented := status.Code(probe()) != codes.Unimplemented
+		if implemented != advertised[rpc] {
+			t.Errorf("capability %v: advertised %v, implemented %v", rpc, advertised[rpc], implemented)
+		}
+	}
+}
+
+func TestValidateVolumeCapabilities(t *testing.T) {
+	controller := NewFakeVultrControllerServer("validate volume capabilities")
+	volumeID := "c56c7b6e-15c2-445e-9a5d-1063ab5828ec"
+
+	tests := []struct {
+		mode      csi.VolumeCapability_AccessMode_Mode
+		confirmed bool
+	}{
+		{mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER, confirmed: true},
+		{mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER, confirmed: true},
+		{mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_MULTI_WRITER, confirmed: true},
+		{mode: csi.VolumeCapability_AccessMode_UNKNOWN},
+		{mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY},
+		{mode: csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY},
+		{mode: csi.VolumeCapability_AccessMode_MULTI_NODE_SINGLE_WRITER},
+		{mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.mode.String(), func(t *testing.T) {
+			capabilities := []*csi.VolumeCapability{
+				{
+					AccessType: &csi.VolumeCapability_Mount{
+						Mount: &csi.VolumeCapability_MountVolume{},
+					},
+					AccessMode: &csi.VolumeCapability_AccessMode{
+						Mode: tt.mode,
+					},
+				},
+			}
+
+			res, err := controller.ValidateVolumeCapabilities(context.Background(), &csi.ValidateVolumeCapabilitiesRequest{
+				VolumeId:           volumeID,
+				VolumeCapabilities: capabilities,
+			})
+			if err != nil {
+				t.Fatalf("Expected no error, got error : %v", err)
+			}
+
+			if tt.confirmed && !reflect.DeepEqual(res.GetConfirmed().GetVolumeCapabilities(), capabilities) {
+				t.Errorf("expected %+v to be confirmed, got %+v", capabilities, res)
+			}
+
+			if !tt.confirmed && (res.Confirmed != nil || res.Message == "") {
+				t.Errorf("expected unconfirmed response with a message, got %+v", res)
+			}
+
+			_, err = controller.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+				Name:               "volume-test-name",
+				VolumeCapabilities: capabilities,
+			})
+			if created := err == nil; created != tt.confirmed {
+				t.Errorf("expected CreateVolume to succeed %v, got %v", tt.confirmed, err)
+			}
+		})
+	}
+
+	_, err := controller.ValidateVolumeCapabilities(context.Background(), &csi.ValidateVolumeCapabilitiesRequest{
+		VolumeId:           volumeID,
+		VolumeCapabilities: []*csi.VolumeCapability{},
+	})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected %v got %v", codes.InvalidArgument, err)
+	}
+}
+
+func TestListVolumes(t *testing.T) {
+	controller := NewFakeVultrControllerServer("list volumes")
+
+	res, err := controller.ListVolumes(context.Background(), &csi.ListVolumesRequest{
+		MaxEntries: 1,
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got error : %v", err)
+	}
+
+	expected := &csi.ListVolumesResponse{
+		Entries: []*csi.ListVolumesResponse_Entry{
+			{
+				Volume: &csi.Volume{
+					VolumeId:      "c56c7b6e-15c2-445e-9a5d-1063ab5828ec",
+					CapacityBytes: 10 * giB,
+				},
+				Status: &csi.ListVolumesResponse_VolumeStatus{
+					PublishedNodeIds: []string{"245bb2fe-b55c-44a0-9a1e-ab80e4b5f088"},
+					VolumeCondition:  &csi.VolumeCondition{Message: "volume is active"},
+				},
+			},
+		},
+		NextToken: "1",
+	}
+
+	if !reflect.DeepEqual(res, expected) {
+		t.Errorf("expected %+v got %+v", expected, res)
+	}
+
+	res, err = controller.ListVolumes(context.Background(), &csi.ListVolumesRequest{
+		MaxEntries:    1,
+		StartingToken: res.NextToken,
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got error : %v", err)
+	}
+
+	if len(res.Entries) != 1 || res.Entries[0].Volume.VolumeId != "bda4f333-bfd7-477b-84c2-e4df0ec9e5bf" || res.NextToken != "" {
+		t.Errorf("unexpected second page %+v", res)
+	}
+
+	for _, token := range []string{"invalid", "-1", "3"} {
+		_, err = controller.ListVolumes(context.Background(), &csi.ListVolumesRequest{
+			StartingToken: token,
+		})
+		if status.Code(err) != codes.Aborted {
+			t.Errorf("token %q: expected %v got %v", token, codes.Aborted, err)
+		}
+	}
+}
+
+func TestListVolumesCondition(t *testing.T) {
+	controller := NewFakeVultrControllerServer("list volumes condition")
+	pending := newFakeBS()
+	pending.Status = "pending"
+	pending.AttachedToInstance = ""
+	controller.Driver.client.BlockStorage = &storingBS{volumes: []govultr.BlockStorage{*pending}}
+
+	res, err := controller.ListVolumes(context.Background(), &csi.ListVolumesRequest{})
+	if err != nil {
+		t.Fatalf("Expected no error, got error : %v", err)
+	}
+
+	if len(res.Entries) != 1 {
+		t.Fatalf("expected 1 entry, got %+v", res.Entries)
+	}
+
+	condition := res.Entries[0].Status.GetVolumeCondition()
+	if !condition.GetAbnormal() || !strings.Contains(condition.GetMessage(), "pending") {
+		t.Errorf("expected an abnormal condition naming the status, got %+v", condition)
+	}
+
+	if nodes := res.Entries[0].Status.GetPublishedNodeIds(); len(nodes) != 0 {
+		t.Errorf("expected no published nodes, got %v", nodes)
+	}
+}
+
+func TestGetStorageBytes(t *testing.T) {
+	tests := []struct {
+		name            string
+		blockType       string
+		capRange        *csi.CapacityRange
+		defaultSize     int64
+		requireCapacity bool
+		expected        int64
+		code            codes.Code
+	}{
+		{
+			name:      "nvme default",
+			blockType: blockTypeNvme,
+			expected:  nvmeVolumeSizeInBytes,
+		},
+		{
+			name:      "hdd default",
+			blockType: blockTypeHDD,
+			expected:  hddDefaultVolumeSizeInBytes,
+		},
+		{
+			name:      "exact GiB",
+			blockType: blockTypeNvme,
+			capRange:  &csi.CapacityRange{RequiredBytes: 20 * giB},
+			expected:  20 * giB,
+		},
+		{
+			name:      "multi GiB with remainder",
+			blockType: blockTypeNvme,
+			capRange:  &csi.CapacityRange{RequiredBytes: 20*giB + 512*miB},
+			expected:  21 * giB,
+		},
+		{
+			name:      "sub GiB raised to minimum",
+			blockType: blockTypeNvme,
+			capRange:  &csi.CapacityRange{RequiredBytes: 512 * miB},
+			expected:  nvmeMinVolumeSizeInBytes,
+		},
+		{
+			name:      "below minimum raised to minimum",
+			blockType: blockTypeHDD,
+			capRange:  &csi.CapacityRange{RequiredBytes: 20 * giB},
+			expected:  hddMinVolumeSizeInBytes,
+		},
+		{
+			name:      "above maximum",
+			blockType: blockTypeNvme,
+			capRange:  &csi.CapacityRange{RequiredBytes: 50 * tiB},
+			code:      codes.OutOfRange,
+		},
+		{
+			name:      "hdd maximum",
+			blockType: blockTypeHDD,
+			capRange:  &csi.CapacityRange{RequiredBytes: hddMaxVolumeSizeInBytes},
+			expected:  hddMaxVolumeSizeInBytes,
+		},
+		{
+			name:      "required within limit",
+			blockType: blockTypeNvme,
+			capRange:  &csi.CapacityRange{RequiredBytes: 20 * giB, LimitBytes: 30 * giB},
+			expected:  20 * giB,
+		},
+		{
+			name:      "limit only below default",
+			blockType: blockTypeHDD,
+			capRange:  &csi.CapacityRange{LimitBytes: 40*giB + 512*miB},
+			expected:  40 * giB,
+		},
+		{
+			name:      "limit only above default",
+			blockType: blockTypeNvme,
+			capRange:  &csi.CapacityRange{LimitBytes: 100*giB + 512*miB},
+			expected:  100 * giB,
+		},
+		{
+			name:      "maximum int64",
+			blockType: blockTypeNvme,
+			capRange:  &csi.CapacityRange{RequiredBytes: math.MaxInt64},
+			code:      codes.OutOfRange,
+		},
+		{
+			name:      "maximum int64 limit",
+			blockType: blockTypeNvme,
+			capRange:  &csi.CapacityRange{LimitBytes: math.MaxInt64},
+			code:      codes.OutOfRange,
+		},
+		{
+			name:      "negative required",
+			blockType: blockTypeNvme,
+			capRange:  &csi.CapacityRange{RequiredBytes: -giB},
+			code:      codes.InvalidArgument,
+		},
+		{
+			name:      "negative limit",
+			blockType: blockTypeNvme,
+			capRange:  &csi.CapacityRange{RequiredBytes: 20 * giB, LimitBytes: -giB},
+			code:      codes.InvalidArgument,
+		},
+		{
+			name:      "required exceeds limit",
+			blockType: blockTypeNvme,
+			capRange:  &csi.CapacityRange{RequiredBytes: 30 * giB, LimitBytes: 20 * giB},
+			code:      codes.OutOfRange,
+		},
+		{
+			name:      "rounded required exceeds limit",
+			blockType: blockTypeNvme,
+			capRange:  &csi.CapacityRange{RequiredBytes: 20*giB + 1, LimitBytes: 20*giB + 512*miB},
+			code:      codes.OutOfRange,
+		},
+		{
+			name:      "limit below minimum",
+			blockType: blockTypeNvme,
+			capRange:  &csi.CapacityRange{LimitBytes: 5 * giB},
+			code:      codes.OutOfRange,
+		},
+		{
+			name:      "unknown block type",
+			blockType: "unknown",
+			code:      codes.InvalidArgument,
+		},
+		{
+			name:        "configured default",
+			blockType:   blockTypeNvme,
+			defaultSize: 20 * giB,
+			expected:    20 * giB,
+		},
+		{
+			name:        "configured default below minimum",
+			blockType:   blockTypeHDD,
+			defaultSize: 20 * giB,
+			expected:    hddMinVolumeSizeInBytes,
+		},
+		{
+			name:            "capacity required",
+			blockType:       blockTypeNvme,
+			requireCapacity: true,
+			code:            codes.InvalidArgument,
+		},
+		{
+			name:            "empty capacity range required",
+			blockType:       blockTypeNvme,
+			capRange:        &csi.CapacityRange{},
+			requireCapacity: true,
+			code:            codes.InvalidArgument,
+		},
+		{
+			name:            "capacity given when required",
+			blockType:       blockTypeNvme,
+			capRange:        &csi.CapacityRange{RequiredBytes: 20 * giB},
+			defaultSize:     30 * giB,
+			requireCapacity: true,
+			expected:        20 * giB,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := getStorageBytes(tt.capRange, tt.blockType, tt.defaultSize, tt.requireCapacity)
+			if status.Code(err) != tt.code {
+				t.Fatalf("expected code %v got %v", tt.code, err)
+			}
+
+			if got != tt.expected {
+				t.Errorf("expected %d got %d", tt.expected, got)
+			}
+		})
+	}
+}
+
+// pendingBS never reports a volume as active
+type pendingBS struct {
+	fakeBS
+	gets int
+}
+
+func (f *pendingBS) Get(ctx context.Context, blockID string) (*govultr.BlockStorage, error) {
+	f.gets++
+	bs := newFakeBS()
+	bs.Status = "pending"
+	return bs, nil
+}
+
+func TestCreateVolumeStatusCheck(t *testing.T) {
+	req := &csi.CreateVolumeRequest{
+		Name:       "volume-test-name",
+		Parameters: map[string]string{"block_type": "high_perf"},
+		VolumeCapabilities: []*csi.VolumeCapability{
+			{
+				AccessType: &csi.VolumeCapability_Mount{
+					Mount: &csi.VolumeCapability_MountVolume{},
+				},
+				AccessMode: &csi.VolumeCapability_AccessMode{
+					Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+				},
+			},
+		},
+	}
+
+	controller := NewFakeVultrControllerServer("create volume status check retries")
+	bs := &pendingBS{}
+	controller.Driver.client.BlockStorage = bs
+	controller.Driver.statusCheckRetries = 3
+
+	_, err := controller.CreateVolume(context.Background(), req)
+	if status.Code(err) != codes.Internal || bs.gets != 3 {
+		t.Errorf("expected %v after 3 status checks, got %v after %d", codes.Internal, err, bs.gets)
+	}
+
+	controller = NewFakeVultrControllerServer("create volume status check deadline")
+	controller.Driver.client.BlockStorage = &pendingBS{}
+	controller.Driver.statusCheckRetries = 1000
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, err = controller.CreateVolume(ctx, req)
+	if status.Code(err) != codes.DeadlineExceeded {
+		t.Errorf("expected %v got %v", codes.DeadlineExceeded, err)
+	}
+}
+
+// blockingBS blocks every list call until the context is done, like an
+// unresponsive Vultr API
+type blockingBS struct {
+	fakeBS
+}
+
+func (f *blockingBS) List(ctx context.Context, options *govultr.ListOptions) ([]govultr.BlockStorage, *govultr.Meta, error) {
+	<-ctx.Done()
+	return nil, nil, ctx.Err()
+}
+
+func TestCreateVolumeCancelled(t *testing.T) {
+	controller := NewFakeVultrControllerServer("create volume cancelled")
+	controller.Driver.client.BlockStorage = &blockingBS{}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := controller.CreateVolume(ctx, &csi.CreateVolumeRequest{
+			Name:       "volume-test-name",
+			Parameters: map[string]string{"block_type": "high_perf"},
+			VolumeCapabilities: []*csi.VolumeCapability{
+				{
+					AccessType: &csi.VolumeCapability_Mount{
+						Mount: &csi.VolumeCapability_MountVolume{},
+					},
+					AccessMode: &csi.VolumeCapability_AccessMode{
+						Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+					},
+				},
+			},
+		})
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if status.Code(err) != codes.Canceled {
+			t.Errorf("expected %v got %v", codes.Canceled, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("CreateVolume did not return after its context was cancelled")
+	}
+}
+
+func TestCreateVolumeAlreadyExists(t *testing.T) {
+	controller := NewFakeVultrControllerServer("create volume already exists")
+
+	req := &csi.CreateVolumeRequest{
+		Name:       "test-bs",
+		Parameters: map[string]string{"block_type": "high_perf"},
+		VolumeCapabilities: []*csi.VolumeCapability{
+			{
+				AccessType: &csi.VolumeCapability_Mount{
+					Mount: &csi.VolumeCapability_MountVolume{},
+				},
+				AccessMode: &csi.VolumeCapability_AccessMode{
+					Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+				},
+			},
+		},
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 10 * giB},
+	}
+
+	// test-bs is a 10 GB volume
+	res, err := controller.CreateVolume(context.Background(), req)
+	if err != nil {
+		t.Fatalf("Expected no error, got error : %v", err)
+	}
+
+	if res.Volume.VolumeId != "c56c7b6e-15c2-445e-9a5d-1063ab5828ec" || res.Volume.CapacityBytes != 10*giB {
+		t.Errorf("expected the existing volume, got %+v", res.Volume)
+	}
+
+	req.CapacityRange = &csi.CapacityRange{RequiredBytes: 20 * giB}
+	_, err = controller.CreateVolume(context.Background(), req)
+	if status.Code(err) != codes.AlreadyExists {
+		t.Errorf("expected %v got %v", codes.AlreadyExists, err)
+	}
+}
+
+// deleteErrorBS fails every delete call with err
+type deleteErrorBS struct {
+	fakeBS
+	err error
+}
+
+func (f *deleteErrorBS) Delete(ctx context.Context, blockID string) error {
+	return f.err
+}
+
+func TestDeleteVolumeErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		code codes.Code
+	}{
+		{
+			name: "not found",
+			err:  errors.New(`{"error":"Block storage not found","status":404}`),
+			code: codes.OK,
+		},
+		{
+			name: "still attached",
+			err:  errors.New(`{"error":"Block storage volume is attached to a server","status":400}`),
+			code: codes.FailedPrecondition,
+		},
+		{
+			name: "transient",
+			err:  errors.New(`gave up after 4 attempts, last error: "upstream unavailable"`),
+			code: codes.Internal,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			controller := NewFakeVultrControllerServer("delete volume " + tt.name)
+			controller.Driver.client.BlockStorage = &deleteErrorBS{err: tt.err}
+
+			_, err := controller.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{
+				VolumeId: "c56c7b6e-15c2-445e-9a5d-1063ab5828ec",
+			})
+
+			if status.Code(err) != tt.code {
+				t.Errorf("expected %v got %v", tt.code, err)
+			}
+		})
+	}
+}
+
+func TestCreateVolumeBlockType(t *testing.T) {
+	controller := NewFakeVultrControllerServer("create volume block type")
+
+	req := &csi.CreateVolumeRequest{
+		Name: "volume-test-name",
+		VolumeCapabilities: []*csi.VolumeCapability{
+			{
+				AccessType: &csi.VolumeCapability_Mount{
+					Mount: &csi.VolumeCapability_MountVolume{},
+				},
+				AccessMode: &csi.VolumeCapability_AccessMode{
+					Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+				},
+			},
+		},
+	}
+
+	// the default block type is NVMe
+	res, err := controller.CreateVolume(context.Background(), req)
+	if err != nil {
+		t.Fatalf("Expected no error, got error : %v", err)
+	}
+
+	if res.Volume.CapacityBytes != nvmeVolumeSizeInBytes {
+		t.Errorf("expected %d got %d", nvmeVolumeSizeInBytes, res.Volume.CapacityBytes)
+	}
+
+	req.Parameters = map[string]string{"block_type": "ssd"}
+	_, err = controller.CreateVolume(context.Background(), req)
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected %v got %v", codes.InvalidArgument, err)
+	}
+}
+
+func TestCreateVolumeFsType(t *testing.T) {
+	controller := NewFakeVultrControllerServer("create volume fs type")
+
+	req := &csi.CreateVolumeRequest{
+		Name: "volume-test-name",
+		VolumeCapabilities: []*csi.VolumeCapability{
+			{
+				AccessType: &csi.VolumeCapability_Mount{
+					Mount: &csi.VolumeCapability_MountVolume{},
+				},
+				AccessMode: &csi.VolumeCapability_AccessMode{
+					Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+				},
+			},
+		},
+		Parameters: map[string]string{fsTypeKey: fsTypeXFS},
+	}
+
+	res, err := controller.CreateVolume(context.Background(), req)
+	if err != nil {
+		t.Fatalf("Expected no error, got error : %v", err)
+	}
+
+	if fsType := res.Volume.VolumeContext[fsTypeKey]; fsType != fsTypeXFS {
+		t.Errorf("expected volume context fs type %q got %q", fsTypeXFS, fsType)
+	}
+
+	req.Parameters = map[string]string{fsTypeKey: "btrfs"}
+	_, err = controller.CreateVolume(context.Background(), req)
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected %v got %v", codes.InvalidArgument, err)
+	}
+}
+
+func TestCreateVolumeEncrypted(t *testing.T) {
+	controller := NewFakeVultrControllerServer("create volume encrypted")
+
+	req := &csi.CreateVolumeRequest{
+		Name: "volume-test-name",
+		VolumeCapabilities: []*csi.VolumeCapability{
+			{
+				AccessType: &csi.VolumeCapability_Mount{
+					Mount: &csi.VolumeCapability_MountVolume{},
+				},
+				AccessMode: &csi.VolumeCapability_AccessMode{
+					Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+				},
+			},
+		},
+		Parameters: map[string]string{encryptedKey: "true"},
+	}
+
+	res, err := controller.CreateVolume(context.Background(), req)
+	if err != nil {
+		t.Fatalf("Expected no error, got error : %v", err)
+	}
+
+	if encrypted := res.Volume.VolumeContext[encryptedKey]; encrypted != "true" {
+		t.Errorf("expected volume context %s %q got %q", encryptedKey, "true", encrypted)
+	}
+
+	req.Parameters = map[string]string{encryptedKey: "yes please"}
+	_, err = controller.CreateVolume(context.Background(), req)
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected %v got %v", codes.InvalidArgument, err)
+	}
+}
+
+func TestTopologyRegions(t *testing.T) {
+	region := func(r string) *csi.Topology {
+		return &csi.Topology{Segments: map[string]string{"region": r}}
+	}
+
+	tests := []struct {
+		name         string
+		requirements *csi.TopologyRequirement
+		expected     []string
+		code         codes.Code
+	}{
+		{
+			name:     "no requirements",
+			expected: []string{"ewr"},
+		},
+		{
+			name: "preferred before requisite",
+			requirements: &csi.TopologyRequirement{
+				Requisite: []*csi.Topology{region("ewr"), region("lax"), region("ord")},
+				Preferred: []*csi.Topology{region("lax")},
+			},
+			expected: []string{"lax", "ewr", "ord"},
+		},
+		{
+			name: "preferred outside requisite",
+			requirements: &csi.TopologyRequirement{
+				Requisite: []*csi.Topology{region("ord")},
+				Preferred: []*csi.Topology{region("lax")},
+			},
+			expected: []string{"ord"},
+		},
+		{
+			name: "unsupported segment",
+			requirements: &csi.TopologyRequirement{
+				Requisite: []*csi.Topology{{Segments: map[string]string{"zone": "a"}}},
+			},
+			code: codes.ResourceExhausted,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			regions, err := topologyRegions(tt.requirements, "ewr")
+			if status.Code(err) != tt.code {
+				t.Fatalf("expected code %v got %v", tt.code, err)
+			}
+
+			if !reflect.DeepEqual(regions, tt.expected) {
+				t.Errorf("expected %v got %v", tt.expected, regions)
+			}
+		})
+	}
+}
+
+// slowCreateBS blocks in Create until release is closed
+type slowCreateBS struct {
+	fakeBS
+	creating chan struct{}
+	release  chan struct{}
+	creates  int32
+}
+
+func (f *slowCreateBS) Create(ctx context.Context, blockReq *govultr.BlockStorageCreate) (*govultr.BlockStorage, error) {
+	atomic.AddInt32(&f.creates, 1)
+	close(f.creating)
+	<-f.release
+	return f.fakeBS.Create(ctx, blockReq)
+}
+
+func TestCreateVolumeInProgress(t *testing.T) {
+	controller := NewFakeVultrControllerServer("create volume in progress")
+	bs := &slowCreateBS{creating: make(chan struct{}), release: make(chan struct{})}
+	controller.Driver.client.BlockStorage = bs
+
+	req := &csi.CreateVolumeRequest{
+		Name: "volume-test-name",
+		VolumeCapabilities: []*csi.VolumeCapability{
+			{
+				AccessType: &csi.VolumeCapability_Mount{
+					Mount: &csi.VolumeCapability_MountVolume{},
+				},
+				AccessMode: &csi.VolumeCapability_AccessMode{
+					Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+				},
+			},
+		},
+	}
+
+	first := make(chan error, 1)
+	go func() {
+		_, err := controller.CreateVolume(context.Background(), req)
+		first <- err
+	}()
+
+	<-bs.creating
+	_, err := controller.CreateVolume(context.Background(), req)
+	if status.Code(err) != codes.Aborted {
+		t.Errorf("Expected code %v for the concurrent request, got %v", codes.Aborted, err)
+	}
+
+	close(bs.release)
+	if err := <-first; err != nil {
+		t.Errorf("Expected no error, got error : %v", err)
+	}
+
+	if creates := atomic.LoadInt32(&bs.creates); creates != 1 {
+		t.Errorf("Expected 1 create, got %d", creates)
+	}
+}
+
+func TestControllerGetVolume(t *testing.T) {
+	volumeID := "c56c7b6e-15c2-445e-9a5d-1063ab5828ec"
+
+	controller := NewFakeVultrControllerServer("controller get volume")
+	res, err := controller.ControllerGetVolume(context.Background(), &csi.ControllerGetVolumeRequest{VolumeId: volumeID})
+	if err != nil {
+		t.Fatalf("Expected no error, got error : %v", err)
+	}
+
+	if res.Volume.CapacityBytes != 10*giB {
+		t.Errorf("Expected capacity %d, got %d", 10*giB, res.Volume.CapacityBytes)
+	}
+
+	if !reflect.DeepEqual(res.Status.PublishedNodeIds, []string{"245bb2fe-b55c-44a0-9a1e-ab80e4b5f088"}) {
+		t.Errorf("Unexpected published nodes: %v", res.Status.PublishedNodeIds)
+	}
+
+	if res.Status.VolumeCondition.Abnormal {
+		t.Errorf("Expected an active volume to be healthy, got %v", res.Status.VolumeCondition)
+	}
+
+	controller.Driver.client.BlockStorage = &pendingBS{}
+	res, err = controller.ControllerGetVolume(context.Background(), &csi.ControllerGetVolumeRequest{VolumeId: volumeID})
+	if err != nil {
+		t.Fatalf("Expected no error, got error : %v", err)
+	}
+
+	if !res.Status.VolumeCondition.Abnormal {
+		t.Errorf("Expected a pending volume to be abnormal, got %v", res.Status.VolumeCondition)
+	}
+
+	controller.Driver.client.BlockStorage = &missingBS{}
+	_, err = controller.ControllerGetVolume(context.Background(), &csi.ControllerGetVolumeRequest{VolumeId: volumeID})
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("Expected code %v, got %v", codes.NotFound, err)
+	}
+}
+
+func TestPublishVolumeNodeFull(t *testing.T) {
+	controller := NewFakeVultrControllerServer("publish volume node full")
+	controller.Driver.maxVolumesPerNode = 1
+	bs := &detachedBS{}
+	controller.Driver.client.BlockStorage = bs
+
+	// the fake volume list already has a volume attached to this node
+	_, err := controller.ControllerPublishVolume(context.Background(), &csi.ControllerPublishVolumeRequest{
+		NodeId:   "245bb2fe-b55c-44a0-9a1e-ab80e4b5f088",
+		VolumeId: "c56c7b6e-15c2-445e-9a5d-1063ab5828ec",
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{
+				Mount: &csi.VolumeCapability_MountVolume{},
+			},
+			AccessMode: &csi.VolumeCapability_AccessMode{
+				Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+			},
+		},
+	})
+
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("Expected code %v, got %v", codes.ResourceExhausted, err)
+	}
+
+	if bs.attachedTo != "" {
+		t.Errorf("Expected volume not to be attached, got %q", bs.attachedTo)
+	}
+}
+
+// nodeBS lists the volumes attached to each node, Attach takes long enough
+// for concurrent publishes to overlap
+type nodeBS struct {
+	fakeBS
+	mu       sync.Mutex
+	attached map[string]string
+}
+
+func (f *nodeBS) Get(ctx context.Context, blockID string) (*govultr.BlockStorage, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	bs := newFakeBS()
+	bs.ID = blockID
+	bs.AttachedToInstance = f.attached[blockID]
+	return bs, nil
+}
+
+func (f *nodeBS) List(ctx context.Context, options *govultr.ListOptions) ([]govultr.BlockStorage, *govultr.Meta, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var list []govultr.BlockStorage
+	for id, instanceID := range f.attached {
+		bs := newFakeBS()
+		bs.ID = id
+		bs.AttachedToInstance = instanceID
+		list = append(list, *bs)
+	}
+	return list, &govultr.Meta{Links: &govultr.Links{}}, nil
+}
+
+func (f *nodeBS) Attach(ctx context.Context, blockID string, attach *govultr.BlockStorageAttach) error {
+	time.Sleep(10 * time.Millisecond)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.attached[blockID] = attach.InstanceID
+	return nil
+}
+
+func TestPublishVolumeNodeFullConcurrent(t *testing.T) {
+	controller := NewFakeVultrControllerServer("publish volume node full concurrent")
+	controller.Driver.maxVolumesPerNode = 1
+	bs := &nodeBS{attached: map[string]string{}}
+	controller.Driver.client.BlockStorage = bs
+
+	volumeIDs := []string{"c56c7b6e-15c2-445e-9a5d-1063ab5828ec", "0b1c2d3e-4f50-4a6b-8c7d-9e0f1a2b3c4d"}
+	errs := make(chan error, len(volumeIDs))
+	for _, volumeID := range volumeIDs {
+		go func(volumeID string) {
+			_, err := controller.ControllerPublishVolume(context.Background(), &csi.ControllerPublishVolumeRequest{
+				NodeId:   "245bb2fe-b55c-44a0-9a1e-ab80e4b5f088",
+				VolumeId: volumeID,
+				VolumeCapability: &csi.VolumeCapability{
+					AccessType: &csi.VolumeCapability_Mount{
+						Mount: &csi.VolumeCapability_MountVolume{},
+					},
+					AccessMode: &csi.VolumeCapability_AccessMode{
+						Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+					},
+				},
+			})
+			errs <- err
+		}(volumeID)
+	}
+
+	exhausted := 0
+	for range volumeIDs {
+		if err := <-errs; status.Code(err) == codes.ResourceExhausted {
+			exhausted++
+		} else if err != nil {
+			t.Errorf("Expected no error, got error : %v", err)
+		}
+	}
+
+	if exhausted != 1 || len(bs.attached) != 1 {
+		t.Errorf("expected one volume attached and one rejected, got %d attached and %d rejected", len(bs.attached), exhausted)
+	}
+}
+
+func TestNodeLocks(t *testing.T) {
+	locks := newNodeLocks()
+	if err := locks.Acquire(context.Background(), "node"); err != nil {
+		t.Fatalf("Expected no error, got error : %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := locks.Acquire(ctx, "node"); status.Code(err) != codes.DeadlineExceeded {
+		t.Errorf("expected %v got %v", codes.DeadlineExceeded, err)
+	}
+
+	locks.Release("node")
+	if len(locks.locks) != 0 {
+		t.Errorf("expected released locks to be forgotten, got %v", locks.locks)
+	}
+
+	if err := locks.Acquire(context.Background(), "node"); err != nil {
+		t.Fatalf("Expected no error, got error : %v", err)
+	}
+	locks.Release("node")
+}
+
+// heldBS is a volume attached to another node that can be detached from it
+type heldBS struct {
+	detachedBS
+}
+
+func (f *heldBS) Detach(ctx context.Context, blockID string, detach *govultr.BlockStorageDetach) error {
+	f.attachedTo = ""
+	return nil
+}
+
+// poweredInstance reports every instance with the given power status
+type poweredInstance struct {
+	FakeInstance
+	powerStatus string
+}
+
+func (f *poweredInstance) Get(ctx context.Context, instanceID string) (*govultr.Instance, error) {
+	instance, err := f.FakeInstance.Get(ctx, instanceID)
+	instance.PowerStatus = f.powerStatus
+	return instance, err
+}
+
+func TestPublishVolumeForceDetach(t *testing.T) {
+	holder := "b9d23eb3-1880-4746-acc7-f1ef56565320"
+	nodeID := "245bb2fe-b55c-44a0-9a1e-ab80e4b5f088"
+
+	tests := []struct {
+		name        string
+		forceDetach bool
+		powerStatus string
+		code        codes.Code
+		attachedTo  string
+	}{
+		{
+			name:        "disabled",
+			powerStatus: "stopped",
+			code:        codes.FailedPrecondition,
+			attachedTo:  holder,
+		},
+		{
+			name:        "holder running",
+			forceDetach: true,
+			powerStatus: "running",
+			code:        codes.FailedPrecondition,
+			attachedTo:  holder,
+		},
+		{
+			name:        "holder stopped",
+			forceDetach: true,
+			powerStatus: "stopped",
+			attachedTo:  nodeID,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			controller := NewFakeVultrControllerServer("publish volume force detach")
+			controller.Driver.forceDetach = tt.forceDetach
+			controller.Driver.client.Instance = &poweredInstance{powerStatus: tt.powerStatus}
+			bs := &heldBS{detachedBS: detachedBS{attachedTo: holder}}
+			controller.Driver.client.BlockStorage = bs
+
+			_, err := controller.ControllerPublishVolume(context.Background(), &csi.ControllerPublishVolumeRequest{
+				NodeId:   nodeID,
+				VolumeId: "c56c7b6e-15c2-445e-9a5d-1063ab5828ec",
+				VolumeCapability: &csi.VolumeCapability{
+					AccessType: &csi.VolumeCapability_Mount{
+						Mount: &csi.VolumeCapability_MountVolume{},
+					},
+					AccessMode: &csi.VolumeCapability_AccessMode{
+						Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+					},
+				},
+			})
+
+			if status.Code(err) != tt.code {
+				t.Errorf("Expected code %v, got %v", tt.code, err)
+			}
+
+			if err != nil && !strings.Contains(err.Error(), holder) {
+				t.Errorf("Expected the error to name node %s, got %v", holder, err)
+			}
+
+			if bs.attachedTo != tt.attachedTo {
+				t.Errorf("Expected volume to be attached to %q, got %q", tt.attachedTo, bs.attachedTo)
+			}
+		})
+	}
+}
+
+func TestVolumeLabel(t *testing.T) {
+	longName := "pvc-" + strings.Repeat("0123456789", 10)
+
+	tests := []struct {
+		name   string
+		volume string
+		prefix string
+		hashed bool
+	}{
+		{
+			name:   "valid name",
+			volume: "pvc-6cd7a1b2-5f1e-4c1d-9f3a-2b8e6a1d0c4f",
+			prefix: "pvc-6cd7a1b2-5f1e-4c1d-9f3a-2b8e6a1d0c4f",
+		},
+		{
+			name:   "illegal characters",
+			volume: "my volume/data",
+			prefix: "myvolumedata-",
+			hashed: true,
+		},
+		{
+			name:   "long name",
+			volume: longName,
+			prefix: longName[:maxVolumeLabelLength-volumeLabelHashLength-1] + "-",
+			hashed: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			label := volumeLabel(test.volume)
+			if !strings.HasPrefix(label, test.prefix) {
+				t.Errorf("expected %q to start with %q", label, test.prefix)
+			}
+
+			if hashed := len(label) == len(test.prefix)+volumeLabelHashLength; hashed != test.hashed {
+				t.Errorf("expected hash suffix %v in %q", test.hashed, label)
+			}
+
+			if len(label) > maxVolumeLabelLength {
+				t.Errorf("label %q is longer than %d", label, maxVolumeLabelLength)
+			}
+
+			if volumeLabelIllegalChars.MatchString(label) {
+				t.Errorf("label %q contains illegal characters", label)
+			}
+
+			if again := volumeLabel(test.volume); again != label {
+				t.Errorf("expected the same label for the same name, got %q and %q", label, again)
+			}
+		})
+	}
+
+	// names that only differ past the cut or in illegal characters must not collide
+	if volumeLabel(longName+"a") == volumeLabel(longName+"b") {
+		t.Error("expected long names differing at the end to map to different labels")
+	}
+
+	if volumeLabel("a b") == volumeLabel("a/b") {
+		t.Error("expected names differing in illegal characters to map to different labels")
+	}
+}
+
+// storingBS keeps created volumes so a retried create can find them
+type storingBS struct {
+	fakeBS
+	volumes []govultr.BlockStorage
+	creates int
+}
+
+func (f *storingBS) Create(ctx context.Context, blockReq *govultr.BlockStorageCreate) (*govultr.BlockStorage, error) {
+	f.creates++
+	bs := newFakeBS()
+	bs.Label = blockReq.Label
+	bs.SizeGB = blockReq.SizeGB
+	bs.AttachedToInstance = ""
+	f.volumes = append(f.volumes, *bs)
+	return bs, nil
+}
+
+func (f *storingBS) List(ctx context.Context, options *govultr.ListOptions) ([]govultr.BlockStorage, *govultr.Meta, error) {
+	return f.volumes, &govultr.Meta{Links: &govultr.Links{}}, nil
+}
+
+// allocatingBS provisions every volume with allocatedGB, whatever size was requested
+type allocatingBS struct {
+	storingBS
+	allocatedGB int
+}
+
+func (f *allocatingBS) Create(ctx context.Context, blockReq *govultr.BlockStorageCreate) (*govultr.BlockStorage, error) {
+	blockReq.SizeGB = f.allocatedGB
+	return f.storingBS.Create(ctx, blockReq)
+}
+
+func (f *allocatingBS) Get(ctx context.Context, blockID string) (*govultr.BlockStorage, error) {
+	bs := f.volumes[len(f.volumes)-1]
+	return &bs, nil
+}
+
+func TestCreateVolumeCapacity(t *testing.T) {
+	controller := NewFakeVultrControllerServer("create volume capacity")
+	controller.Driver.client.BlockStorage = &allocatingBS{allocatedGB: 12}
+
+	req := &csi.CreateVolumeRequest{
+		Name:          "volume-test-name",
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 10 * giB},
+		VolumeCapabilities: []*csi.VolumeCapability{
+			{
+				AccessType: &csi.VolumeCapability_Mount{
+					Mount: &csi.VolumeCapability_MountVolume{},
+				},
+				AccessMode: &csi.VolumeCapability_AccessMode{
+					Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+				},
+			},
+		},
+	}
+
+	// the first call creates the volume, the second finds it
+	for i := 0; i < 2; i++ {
+		res, err := controller.CreateVolume(context.Background(), req)
+		if err != nil {
+			t.Fatalf("Expected no error, got error : %v", err)
+		}
+
+		if res.Volume.CapacityBytes != 12*giB {
+			t.Errorf("call %d: expected the allocated capacity %d, got %d", i+1, 12*giB, res.Volume.CapacityBytes)
+		}
+	}
+}
+
+func TestCreateVolumeExistingTopology(t *testing.T) {
+	region := func(r string) *csi.Topology {
+		return &csi.Topology{Segments: map[string]string{"region": r}}
+	}
+
+	tests := []struct {
+		name         string
+		requirements *csi.TopologyRequirement
+		code         codes.Code
+	}{
+		{name: "no requirements"},
+		{
+			name:         "requisite region",
+			requirements: &csi.TopologyRequirement{Requisite: []*csi.Topology{region("lax"), region("ewr")}},
+		},
+		{
+			name:         "outside requisite regions",
+			requirements: &csi.TopologyRequirement{Requisite: []*csi.Topology{region("lax")}},
+			code:         codes.AlreadyExists,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			controller := NewFakeVultrControllerServer("create volume existing topology")
+			existing := newFakeBS()
+			existing.Label = "volume-test-name"
+			bs := &storingBS{volumes: []govultr.BlockStorage{*existing}}
+			controller.Driver.client.BlockStorage = bs
+
+			res, err := controller.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+				Name: "volume-test-name",
+				VolumeCapabilities: []*csi.VolumeCapability{
+					{
+						AccessType: &csi.VolumeCapability_Mount{
+							Mount: &csi.VolumeCapability_MountVolume{},
+						},
+						AccessMode: &csi.VolumeCapability_AccessMode{
+							Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+						},
+					},
+				},
+				AccessibilityRequirements: tt.requirements,
+			})
+
+			if status.Code(err) != tt.code {
+				t.Fatalf("expected %v got %v", tt.code, err)
+			}
+
+			if bs.creates != 0 {
+				t.Errorf("expected the existing volume to be used, got %d creates", bs.creates)
+			}
+
+			if err != nil {
+				return
+			}
+
+			expected := []*csi.Topology{region(existing.Region)}
+			if !reflect.DeepEqual(res.Volume.AccessibleTopology, expected) {
+				t.Errorf("expected topology %v got %v", expected, res.Volume.AccessibleTopology)
+			}
+		})
+	}
+}
+
+func TestCreateVolumeLabelLookup(t *testing.T) {
+	controller := NewFakeVultrControllerServer("create volume label lookup")
+	bs := &storingBS{}
+	controller.Driver.client.BlockStorage = bs
+
+	req := &csi.CreateVolumeRequest{
+		Name: "pvc-" + strings.Repeat("0123456789", 10),
+		VolumeCapabilities: []*csi.VolumeCapability{
+			{
+				AccessType: &csi.VolumeCapability_Mount{
+					Mount: &csi.VolumeCapability_MountVolume{},
+				},
+				AccessMode: &csi.VolumeCapability_AccessMode{
+					Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+				},
+			},
+		},
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := controller.CreateVolume(context.Background(), req); err != nil {
+			t.Fatalf("Expected no error, got error : %v", err)
+		}
+	}
+
+	if bs.creates != 1 {
+		t.Errorf("Expected the retried create to find the volume, got %d creates", bs.creates)
+	}
+
+	if label := bs.volumes[0].Label; label != volumeLabel(req.Name) {
+		t.Errorf("expected label %q got %q", volumeLabel(req.Name), label)
+	}
+}
@@ -0,0 +1,211 @@
+/*
+Copyright 2020 Vultr Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/sirupsen/logrus"
+	"github.com/vultr/govultr/v2"
+	"google.golang.org/grpc"
+)
+
+const (
+	debugVolumePath     = "/debug/volumes/"
+	maxOperationHistory = 20
+	// maxTrackedVolumes bounds the history of a long running controller, the
+	// volumes with the oldest operations are forgotten first
+	maxTrackedVolumes = 1000
+)
+
+// operation is a single gRPC call made against a volume
+type operation struct {
+	Time   time.Time `json:"time"`
+	Method string    `json:"method"`
+	NodeID string    `json:"node_id,omitempty"`
+	Error  string    `json:"error,omitempty"`
+}
+
+// volumeOperations is the history of a single volume
+type volumeOperations struct {
+	volumeID   string
+	operations []operation
+}
+
+// operationHistory keeps the most recent operations per volume ID for the
+// most recently used volumes
+type operationHistory struct {
+	mu      sync.Mutex
+	volumes map[string]*list.Element
+	order   *list.List
+}
+
+func newOperationHistory() *operationHistory {
+	return &operationHistory{volumes: map[string]*list.Element{}, order: list.New()}
+}
+
+func (h *operationHistory) record(volumeID string, op operation) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	elem, ok := h.volumes[volumeID]
+	if ok {
+		h.order.MoveToFront(elem)
+	} else {
+		elem = h.order.PushFront(&volumeOperations{volumeID: volumeID})
+		h.volumes[volumeID] = elem
+	}
+
+	vol := elem.Value.(*volumeOperations)
+	vol.operations = append(vol.operations, op)
+	if len(vol.operations) > maxOperationHistory {
+		vol.operations = vol.operations[len(vol.operations)-maxOperationHistory:]
+	}
+
+	if h.order.Len() > maxTrackedVolumes {
+		oldest := h.order.Back()
+		h.order.Remove(oldest)
+		delete(h.volumes, oldest.Value.(*volumeOperations).volumeID)
+	}
+}
+
+func (h *operationHistory) get(volumeID string) []operation {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	elem, ok := h.volumes[volumeID]
+	if !ok {
+		return nil
+	}
+	return append([]operation(nil), elem.Value.(*volumeOperations).operations...)
+}
+
+// Interceptor records every call that carries or creates a volume ID. Requests are
+// never stored, so secrets passed to the driver do not end up in the history.
+func (h *operationHistory) Interceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) { //nolint:lll
+	resp, err := handler(ctx, req)
+
+	var volumeID string
+	if volumeReq, ok := req.(interface{ GetVolumeId() string }); ok {
+		volumeID = volumeReq.GetVolumeId()
+	}
+
+	// a created volume only gets its ID from the response
+	if created, ok := resp.(*csi.CreateVolumeResponse); ok && err == nil {
+		volumeID = created.GetVolume().GetVolumeId()
+	}
+
+	if volumeID == "" {
+		return resp, err
+	}
+
+	op := operation{
+		Time:   time.Now().UTC(),
+		Method: info.FullMethod,
+	}
+	if nodeReq, ok := req.(interface{ GetNodeId() string }); ok {
+		op.NodeID = nodeReq.GetNodeId()
+	}
+	if err != nil {
+		op.Error = err.Error()
+	}
+
+	h.record(volumeID, op)
+	return resp, err
+}
+
+// volumeDump is everything the driver knows about a volume
+type volumeDump struct {
+	VolumeID     string                `json:"volume_id"`
+	BlockStorage *govultr.BlockStorage `json:"block_storage,omitempty"`
+	AttachedTo   string                `json:"attached_to,omitempty"`
+	Operations   []operation           `json:"operations"`
+	Error        string                `json:"error,omitempty"`
+}
+
+// debugHandler serves the driver's view of a volume on /debug/volumes/<volume-id>
+func (d *VultrDriver) debugHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(debugVolumePath, func(w http.ResponseWriter, r *http.Request) {
+		volumeID := strings.TrimPrefix(r.URL.Path, debugVolumePath)
+		if volumeID == "" || strings.Contains(volumeID, "/") {
+			http.Error(w, "volume id must be provided", http.StatusBadRequest)
+			return
+		}
+
+		dump := volumeDump{
+			VolumeID:   volumeID,
+			Operations: d.history.get(volumeID),
+		}
+
+		code := http.StatusOK
+		bs, err := d.client.BlockStorage.Get(r.Context(), volumeID)
+		switch {
+		case err != nil && isNotFound(err):
+			code = http.StatusNotFound
+			dump.Error = "volume not found: " + err.Error()
+		case err != nil:
+			// the history is still useful when the API cannot be reached
+			code = http.StatusBadGateway
+			dump.Error = "cannot get volume: " + err.Error()
+		default:
+			dump.BlockStorage = bs
+			dump.AttachedTo = bs.AttachedToInstance
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		if err := json.NewEncoder(w).Encode(dump); err != nil {
+			d.log.WithError(err).Error("cannot write volume debug dump")
+		}
+	})
+
+	return mux
+}
+
+// serveDebug starts the debug HTTP server on the configured address
+func (d *VultrDriver) serveDebug() {
+	addr := debugListenAddr(d.debugAddr)
+	d.log.WithFields(logrus.Fields{
+		"address": addr,
+	}).Info("serving debug endpoint")
+
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           d.debugHandler(),
+		ReadHeaderTimeout: defaultTimeout,
+	}
+
+	if err := server.ListenAndServe(); err != nil {
+		d.log.WithError(err).Error("debug endpoint stopped")
+	}
+}
+
+// debugListenAddr binds an address without a host to loopback, the endpoint
+// has no authentication and serves the account's block storage details
+func debugListenAddr(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || host != "" {
+		return addr
+	}
+	return net.JoinHostPort("127.0.0.1", port)
+}
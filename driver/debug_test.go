@@ -0,0 +1,148 @@
+package driver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/vultr/govultr/v2"
+	"google.golang.org/grpc"
+)
+
+// missingBS never finds a volume
+type missingBS struct {
+	fakeBS
+}
+
+func (f *missingBS) Get(ctx context.Context, blockID string) (*govultr.BlockStorage, error) {
+	return nil, errors.New(`{"error":"Invalid block storage ID","status":404}`)
+}
+
+func TestDebugVolumeDump(t *testing.T) {
+	controller := NewFakeVultrControllerServer("debug volume dump")
+	d := controller.Driver
+
+	volumeID := "c56c7b6e-15c2-445e-9a5d-1063ab5828ec"
+	nodeID := "245bb2fe-b55c-44a0-9a1e-ab80e4b5f088"
+
+	info := &grpc.UnaryServerInfo{FullMethod: "/csi.v1.Controller/ControllerPublishVolume"}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return &csi.ControllerPublishVolumeResponse{}, nil
+	}
+	req := &csi.ControllerPublishVolumeRequest{VolumeId: volumeID, NodeId: nodeID, Secrets: map[string]string{"token": "secret"}}
+	if _, err := d.history.Interceptor(context.Background(), req, info, handler); err != nil {
+		t.Fatalf("Expected no error, got error : %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	d.debugHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, debugVolumePath+volumeID, nil))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status %d got %d", http.StatusOK, rec.Code)
+	}
+
+	var dump volumeDump
+	if err := json.Unmarshal(rec.Body.Bytes(), &dump); err != nil {
+		t.Fatalf("cannot decode dump: %v", err)
+	}
+
+	if dump.VolumeID != volumeID || dump.BlockStorage == nil || dump.AttachedTo != nodeID {
+		t.Errorf("unexpected volume details in dump: %+v", dump)
+	}
+
+	if len(dump.Operations) != 1 || dump.Operations[0].Method != info.FullMethod || dump.Operations[0].NodeID != nodeID {
+		t.Errorf("unexpected operation history in dump: %+v", dump.Operations)
+	}
+
+	if strings.Contains(rec.Body.String(), "secret") {
+		t.Errorf("dump must not contain request secrets: %s", rec.Body.String())
+	}
+}
+
+func TestDebugVolumeDumpNotFound(t *testing.T) {
+	controller := NewFakeVultrControllerServer("debug volume dump not found")
+	d := controller.Driver
+	d.client.BlockStorage = &missingBS{}
+
+	rec := httptest.NewRecorder()
+	d.debugHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, debugVolumePath+"unknown", nil))
+
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected status %d got %d", http.StatusNotFound, rec.Code)
+	}
+}
+
+func TestDebugVolumeDumpAPIError(t *testing.T) {
+	controller := NewFakeVultrControllerServer("debug volume dump api error")
+	d := controller.Driver
+	d.client.BlockStorage = &getErrorBS{err: errors.New(`{"error":"Invalid API token.","status":401}`)}
+
+	rec := httptest.NewRecorder()
+	d.debugHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, debugVolumePath+"c56c7b6e-15c2-445e-9a5d-1063ab5828ec", nil))
+
+	if rec.Code != http.StatusBadGateway {
+		t.Errorf("expected status %d got %d", http.StatusBadGateway, rec.Code)
+	}
+}
+
+func TestOperationHistoryCreateVolume(t *testing.T) {
+	history := newOperationHistory()
+	volumeID := "c56c7b6e-15c2-445e-9a5d-1063ab5828ec"
+
+	info := &grpc.UnaryServerInfo{FullMethod: "/csi.v1.Controller/CreateVolume"}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return &csi.CreateVolumeResponse{Volume: &csi.Volume{VolumeId: volumeID}}, nil
+	}
+	if _, err := history.Interceptor(context.Background(), &csi.CreateVolumeRequest{Name: "pvc-test"}, info, handler); err != nil {
+		t.Fatalf("Expected no error, got error : %v", err)
+	}
+
+	ops := history.get(volumeID)
+	if len(ops) != 1 || ops[0].Method != info.FullMethod {
+		t.Errorf("expected the create to be recorded under the new volume ID, got %+v", ops)
+	}
+}
+
+func TestOperationHistoryEviction(t *testing.T) {
+	history := newOperationHistory()
+
+	for i := 0; i <= maxTrackedVolumes; i++ {
+		history.record(fmt.Sprintf("volume-%d", i), operation{Method: "/csi.v1.Controller/ControllerPublishVolume"})
+
+		// the first volume stays in use and must not be evicted
+		history.record("volume-0", operation{Method: "/csi.v1.Controller/ControllerPublishVolume"})
+	}
+
+	if len(history.volumes) != maxTrackedVolumes || history.order.Len() != maxTrackedVolumes {
+		t.Errorf("expected %d tracked volumes, got %d", maxTrackedVolumes, len(history.volumes))
+	}
+
+	if len(history.get("volume-0")) == 0 {
+		t.Error("expected the most recently used volume to be kept")
+	}
+
+	if len(history.get("volume-1")) != 0 {
+		t.Error("expected the least recently used volume to be evicted")
+	}
+}
+
+func TestDebugListenAddr(t *testing.T) {
+	tests := map[string]string{
+		":9808":          "127.0.0.1:9808",
+		"0.0.0.0:9808":   "0.0.0.0:9808",
+		"10.0.0.1:9808":  "10.0.0.1:9808",
+		"localhost:9808": "localhost:9808",
+	}
+
+	for addr, expected := range tests {
+		if got := debugListenAddr(addr); got != expected {
+			t.Errorf("expected %s for %s, got %s", expected, addr, got)
+		}
+	}
+}
@@ -16,6 +16,7 @@ package driver
 import (
 	"context"
 	"fmt"
+	"sync/atomic"
 	"time"
 
 	"github.com/sirupsen/logrus"
@@ -27,6 +28,9 @@ import (
 const (
 	DefaultDriverName = "block.csi.vultr.com"
 	defaultTimeout    = 1 * time.Minute
+
+	// DefaultMaxVolumesPerNode is the number of block storage volumes that can be attached to an instance
+	DefaultMaxVolumesPerNode = 16
 )
 
 // VultrDriver struct
@@ -40,16 +44,103 @@ type VultrDriver struct {
 	publishVolumeID string
 	mountID         string
 
-	isController bool
-	waitTimeout  time.Duration
+	isController      bool
+	waitTimeout       time.Duration
+	strictIdempotency bool
+	forceDetach       bool
+
+	statusCheckRetries     int
+	statusCheckInterval    time.Duration
+	statusCheckMaxInterval time.Duration
+
+	maxVolumesPerNode int
+
+	// defaultVolumeSize replaces the block type default size when set,
+	// requireCapacity rejects volumes requested without a size instead
+	defaultVolumeSize int64
+	requireCapacity   bool
 
-	log     *logrus.Entry
-	mounter Mounter
+	log       *logrus.Entry
+	requestID atomic.Uint64
+	mounter   Mounter
+	locks     *volumeLocks
+	nodeLocks *nodeLocks
+
+	debugAddr string
+	history   *operationHistory
 
 	version string
 }
 
-func NewDriver(endpoint, token, driverName, version, userAgent, apiURL string) (*VultrDriver, error) {
+// Option configures optional behavior of the VultrDriver
+type Option func(*VultrDriver)
+
+// WithStrictIdempotency re-reads volume state before and after every mutating
+// controller call and fails the call when the state is inconsistent
+func WithStrictIdempotency(enabled bool) Option {
+	return func(d *VultrDriver) {
+		d.strictIdempotency = enabled
+	}
+}
+
+// WithVolumeStatusCheck configures how often the controller polls a volume
+// while waiting on it, the interval doubles after every poll up to maxInterval
+func WithVolumeStatusCheck(retries int, interval, maxInterval time.Duration) Option {
+	return func(d *VultrDriver) {
+		d.statusCheckRetries = retries
+		d.statusCheckInterval = interval
+		d.statusCheckMaxInterval = maxInterval
+	}
+}
+
+// WithDebugAddr serves the volume debug endpoint on addr, it is disabled when addr is empty
+// and bound to loopback when addr has no host
+func WithDebugAddr(addr string) Option {
+	return func(d *VultrDriver) {
+		d.debugAddr = addr
+	}
+}
+
+// WithMaxVolumesPerNode sets how many volumes can be attached to a single node,
+// the limit can differ by plan
+func WithMaxVolumesPerNode(n int) Option {
+	return func(d *VultrDriver) {
+		d.maxVolumesPerNode = n
+	}
+}
+
+// WithDefaultVolumeSizeGB sets the size of volumes requested without a
+// capacity range, zero keeps the default of the block type
+func WithDefaultVolumeSizeGB(sizeGB int) Option {
+	return func(d *VultrDriver) {
+		d.defaultVolumeSize = int64(sizeGB) * giB
+	}
+}
+
+// WithRequireCapacity rejects volumes requested without a capacity range
+// instead of creating them with the default size
+func WithRequireCapacity(enabled bool) Option {
+	return func(d *VultrDriver) {
+		d.requireCapacity = enabled
+	}
+}
+
+// WithForceDetach lets ControllerPublishVolume detach a volume from a node
+// that is no longer running before attaching it to the requested node
+func WithForceDetach(enabled bool) Option {
+	return func(d *VultrDriver) {
+		d.forceDetach = enabled
+	}
+}
+
+// WithLogLevel sets the level of the driver's logs
+func WithLogLevel(level logrus.Level) Option {
+	return func(d *VultrDriver) {
+		d.log.Logger.SetLevel(level)
+	}
+}
+
+func NewDriver(endpoint, token, driverName, version, userAgent, apiURL string, opts ...Option) (*VultrDriver, error) {
 	if driverName == "" {
 		driverName = DefaultDriverName
 	}
@@ -73,6 +164,8 @@ func NewDriver(endpoint, token, driverName, version, userAgent, apiURL string) (
 		}
 	}
 
+	client.BlockStorage = newRateLimitedBlockStorage(client.BlockStorage)
+
 	c := metadata.NewClient()
 	meta, err := c.Metadata()
 	if err != nil {
@@ -85,7 +178,7 @@ func NewDriver(endpoint, token, driverName, version, userAgent, apiURL string) (
 		"version": version,
 	})
 
-	return &VultrDriver{
+	d := &VultrDriver{
 		name:     driverName,
 		endpoint: endpoint,
 		nodeID:   meta.InstanceV2ID,
@@ -95,19 +188,65 @@ func NewDriver(endpoint, token, driverName, version, userAgent, apiURL string) (
 		isController: token != "",
 		waitTimeout:  defaultTimeout,
 
-		log:     log,
-		mounter: NewMounter(log),
+		statusCheckRetries:     DefaultVolumeStatusCheckRetries,
+		statusCheckInterval:    DefaultVolumeStatusCheckInterval,
+		statusCheckMaxInterval: DefaultVolumeStatusCheckMaxInterval,
+
+		maxVolumesPerNode: DefaultMaxVolumesPerNode,
+
+		log:       log,
+		mounter:   NewMounter(log),
+		locks:     newVolumeLocks(),
+		nodeLocks: newNodeLocks(),
+		history:   newOperationHistory(),
 
 		version: version,
-	}, nil
+	}
+
+	for _, opt := range opts {
+		opt(d)
+	}
+
+	if err := d.validate(ctx); err != nil {
+		return nil, err
+	}
+
+	return d, nil
+}
+
+// validate fails fast on a misconfigured driver instead of letting every
+// request fail later, including a region or token the API does not accept
+func (d *VultrDriver) validate(ctx context.Context) error {
+	if d.statusCheckRetries <= 0 || d.statusCheckInterval <= 0 || d.statusCheckMaxInterval < d.statusCheckInterval {
+		return fmt.Errorf("invalid volume status check configuration: %d retries, %v interval, %v max interval",
+			d.statusCheckRetries, d.statusCheckInterval, d.statusCheckMaxInterval)
+	}
+
+	if d.maxVolumesPerNode <= 0 {
+		return fmt.Errorf("invalid max volumes per node: %d", d.maxVolumesPerNode)
+	}
+
+	if d.defaultVolumeSize < 0 {
+		return fmt.Errorf("invalid default volume size: %d", d.defaultVolumeSize)
+	}
+
+	if err := d.checkHealth(ctx); err != nil {
+		return fmt.Errorf("invalid driver configuration: %v", err)
+	}
+
+	return nil
 }
 
 func (d *VultrDriver) Run() {
-	server := NewNonBlockingGRPCServer()
+	server := NewNonBlockingGRPCServer(d.logInterceptor, d.history.Interceptor)
 	identity := NewVultrIdentityServer(d)
 	controller := NewVultrControllerServer(d)
 	node := NewVultrNodeDriver(d)
 
+	if d.debugAddr != "" {
+		go d.serveDebug()
+	}
+
 	server.Start(d.endpoint, identity, controller, node)
 	server.Wait()
 }
@@ -2,8 +2,10 @@ package driver
 
 import (
 	"context"
+	"fmt"
 	"math/rand"
 	"os"
+	"strings"
 	"testing"
 	"time"
 
@@ -49,10 +51,14 @@ func TestDriverSuite(t *testing.T) {
 		nodeID: nodeID,
 		region: region,
 
-		waitTimeout: defaultTimeout,
+		waitTimeout:       defaultTimeout,
+		maxVolumesPerNode: DefaultMaxVolumesPerNode,
 
-		log:     log,
-		mounter: NewFakeMounter(log),
+		log:       log,
+		mounter:   NewFakeMounter(log),
+		locks:     newVolumeLocks(),
+		nodeLocks: newNodeLocks(),
+		history:   newOperationHistory(),
 	}
 
 	go d.Run()
@@ -70,30 +76,82 @@ func TestDriverSuite(t *testing.T) {
 type fakeMounter struct {
 	log     *logrus.Entry
 	mounted map[string]string
+	// options holds the mount options each target was mounted with
+	options map[string][]string
+	// deviceSizes holds the successive sizes reported for a device, the
+	// last one is repeated once the others are used up
+	deviceSizes map[string][]int64
+	resized     map[string]string
+	formatted   map[string]string
+	formats     int
+	blocks      map[string]bool
+	// luks maps encrypted devices to their passphrase, luksOpen maps open
+	// mapper names to their device
+	luks        map[string]string
+	luksOpen    map[string]string
+	luksResized map[string]bool
+	// busy targets cannot be unmounted, removed holds removed paths
+	busy    map[string]bool
+	removed map[string]bool
+	// devices under diskPath exist unless listed in missingDevices, which
+	// holds how many more checks report them absent
+	missingDevices map[string]int
 }
 
 func NewFakeMounter(log *logrus.Entry) *fakeMounter {
-	return &fakeMounter{log: log}
+	return &fakeMounter{
+		log:         log,
+		mounted:     map[string]string{},
+		options:     map[string][]string{},
+		deviceSizes: map[string][]int64{},
+		resized:     map[string]string{},
+		formatted:   map[string]string{},
+		blocks:      map[string]bool{},
+		luks:        map[string]string{},
+		luksOpen:    map[string]string{},
+		luksResized: map[string]bool{},
+
+		busy:           map[string]bool{},
+		removed:        map[string]bool{},
+		missingDevices: map[string]int{},
+	}
 }
 
 func (f *fakeMounter) Format(source, fs string) error {
+	f.formatted[source] = fs
+	f.formats++
 	return nil
 }
 
 func (f *fakeMounter) IsFormatted(source string) (bool, error) {
-	return true, nil
+	_, ok := f.formatted[source]
+	return ok, nil
 }
 
 func (f *fakeMounter) Mount(source, target, fs string, opts ...string) error {
+	f.mounted[target] = source
+	f.options[target] = opts
+	return nil
+}
+
+func (f *fakeMounter) MountBlock(source, target string, opts ...string) error {
+	f.mounted[target] = source
+	f.blocks[target] = true
 	return nil
 }
 
 func (f *fakeMounter) IsMounted(target string) (bool, error) {
-	return true, nil
+	_, ok := f.mounted[target]
+	return ok, nil
 }
 
 func (f *fakeMounter) UnMount(target string) error {
+	if f.busy[target] {
+		return fmt.Errorf("unmounting failed: umount: %s: target is busy", target)
+	}
+
 	delete(f.mounted, target)
+	delete(f.blocks, target)
 	return nil
 }
 
@@ -110,5 +168,127 @@ func (f *fakeMounter) GetStatistics(volumePath string) (volumeStatistics, error)
 }
 
 func (f *fakeMounter) IsBlockDevice(volumePath string) (bool, error) {
-	return false, nil
+	return f.blocks[volumePath], nil
+}
+
+func (f *fakeMounter) PathExists(path string) (bool, error) {
+	if strings.HasPrefix(path, diskPath) {
+		if f.missingDevices[path] > 0 {
+			f.missingDevices[path]--
+			return false, nil
+		}
+		return true, nil
+	}
+
+	_, ok := f.mounted[path]
+	return ok, nil
+}
+
+func (f *fakeMounter) RemovePath(path string) error {
+	f.removed[path] = true
+	return nil
+}
+
+func (f *fakeMounter) FindMount(target string) (source, fs string, err error) {
+	source, ok := f.mounted[target]
+	if !ok {
+		return "", "", fmt.Errorf("%s is not mounted", target)
+	}
+
+	return source, "ext4", nil
+}
+
+func (f *fakeMounter) GetDeviceSize(device string) (int64, error) {
+	sizes := f.deviceSizes[device]
+	if len(sizes) == 0 {
+		return 10 * giB, nil
+	}
+
+	size := sizes[0]
+	if len(sizes) > 1 {
+		f.deviceSizes[device] = sizes[1:]
+	}
+
+	return size, nil
+}
+
+func (f *fakeMounter) Resize(source, target, fs string) error {
+	f.resized[target] = fs
+	return nil
+}
+
+func (f *fakeMounter) IsLuks(device string) (bool, error) {
+	_, ok := f.luks[device]
+	return ok, nil
+}
+
+func (f *fakeMounter) LuksFormat(device, passphrase string) error {
+	f.luks[device] = passphrase
+	return nil
+}
+
+func (f *fakeMounter) LuksOpen(device, name, passphrase string) error {
+	if f.luks[device] != passphrase {
+		return fmt.Errorf("no key available with this passphrase for %s", device)
+	}
+	f.luksOpen[name] = device
+	return nil
+}
+
+func (f *fakeMounter) LuksClose(name string) error {
+	delete(f.luksOpen, name)
+	return nil
+}
+
+func (f *fakeMounter) IsLuksOpen(name string) (bool, error) {
+	_, ok := f.luksOpen[name]
+	return ok, nil
+}
+
+func (f *fakeMounter) LuksDevice(name string) (string, error) {
+	device, ok := f.luksOpen[name]
+	if !ok {
+		return "", fmt.Errorf("%s is not open", name)
+	}
+	return device, nil
+}
+
+func (f *fakeMounter) LuksResize(name, passphrase string) error {
+	if f.luks[f.luksOpen[name]] != passphrase {
+		return fmt.Errorf("no key available with this passphrase for %s", name)
+	}
+	f.luksResized[name] = true
+	return nil
+}
+
+func TestDriverValidate(t *testing.T) {
+	tests := []struct {
+		name        string
+		region      string
+		bs          govultr.BlockStorageService
+		defaultSize int64
+		valid       bool
+	}{
+		{name: "valid", region: "ewr", valid: true},
+		{name: "missing region", region: ""},
+		{name: "invalid region", region: "not a region"},
+		{name: "invalid token", region: "ewr", bs: &authErrorBS{}},
+		{name: "negative default volume size", region: "ewr", defaultSize: -giB},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			d := NewFakeVultrControllerServer(test.name).Driver
+			d.region = test.region
+			d.defaultVolumeSize = test.defaultSize
+			if test.bs != nil {
+				d.client.BlockStorage = test.bs
+			}
+
+			err := d.validate(context.Background())
+			if (err == nil) != test.valid {
+				t.Errorf("Expected valid %v, got error : %v", test.valid, err)
+			}
+		})
+	}
 }
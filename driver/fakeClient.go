@@ -31,7 +31,9 @@ func newFakeBS() *govultr.BlockStorage {
 }
 
 type fakeBS struct {
-	client *govultr.Client
+	client   *govultr.Client
+	detached map[string]bool
+	resized  map[string]int
 }
 
 func (f *fakeBS) Create(ctx context.Context, blockReq *govultr.BlockStorageCreate) (*govultr.BlockStorage, error) {
@@ -39,11 +41,25 @@ func (f *fakeBS) Create(ctx context.Context, blockReq *govultr.BlockStorageCreat
 }
 
 func (f *fakeBS) Get(ctx context.Context, blockID string) (*govultr.BlockStorage, error) {
-	return newFakeBS(), nil
+	bs := newFakeBS()
+	if f.detached[blockID] {
+		bs.AttachedToInstance = ""
+	}
+	if size, ok := f.resized[blockID]; ok {
+		bs.SizeGB = size
+	}
+	return bs, nil
 }
 
 func (f *fakeBS) Update(ctx context.Context, blockID string, blockReq *govultr.BlockStorageUpdate) error {
-	panic("implement me")
+	if f.resized == nil {
+		f.resized = map[string]int{}
+	}
+
+	if blockReq.SizeGB != 0 {
+		f.resized[blockID] = blockReq.SizeGB
+	}
+	return nil
 }
 
 func (f *fakeBS) Delete(ctx context.Context, blockID string) error {
@@ -88,17 +104,11 @@ func (f *fakeBS) Attach(ctx context.Context, blockID string, attach *govultr.Blo
 }
 
 func (f *fakeBS) Detach(ctx context.Context, blockID string, detach *govultr.BlockStorageDetach) error {
-	list, _, err := f.List(ctx, nil)
-	if err != nil {
-		return err
-	}
-
-	for i := range list {
-		if list[i].ID == blockID {
-			list[i].AttachedToInstance = ""
-		}
+	if f.detached == nil {
+		f.detached = map[string]bool{}
 	}
 
+	f.detached[blockID] = true
 	return nil
 }
 
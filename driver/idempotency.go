@@ -0,0 +1,146 @@
+/*
+Copyright 2020 Vultr Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+	"github.com/vultr/govultr/v2"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	verifyBefore = "before"
+	verifyAfter  = "after"
+)
+
+// volumeCheck inspects the result of re-reading a volume and returns an error
+// describing any inconsistency with the request
+type volumeCheck func(bs *govultr.BlockStorage, err error) error
+
+// verifyVolume re-reads the volume and runs check against it when strict
+// idempotency checking is enabled. A failed check before the mutation refuses
+// the call with FailedPrecondition, a failed check after it returns Internal.
+func (c *VultrControllerServer) verifyVolume(ctx context.Context, method, phase, volumeID string, check volumeCheck) error {
+	if !c.Driver.strictIdempotency {
+		return nil
+	}
+
+	bs, err := c.Driver.client.BlockStorage.Get(ctx, volumeID)
+
+	log := c.Driver.logger(ctx).WithFields(logrus.Fields{
+		"method":    method,
+		"phase":     phase,
+		"volume-id": volumeID,
+		"state":     bs,
+	})
+
+	if checkErr := check(bs, err); checkErr != nil {
+		log.WithError(checkErr).Error("strict idempotency check failed")
+
+		code := codes.FailedPrecondition
+		if phase == verifyAfter {
+			code = codes.Internal
+		}
+		return status.Errorf(code, "%s strict idempotency check %s mutation failed: %v", method, phase, checkErr)
+	}
+
+	log.Info("strict idempotency check passed")
+	return nil
+}
+
+// volumeExists checks that the volume can be read back
+func volumeExists(bs *govultr.BlockStorage, err error) error {
+	if err != nil {
+		return fmt.Errorf("cannot get volume: %v", err)
+	}
+	return nil
+}
+
+// volumeDeleted checks that the API reports the volume as not found, other
+// errors say nothing about whether it is gone
+func volumeDeleted(bs *govultr.BlockStorage, err error) error {
+	if err == nil {
+		return fmt.Errorf("volume still exists with status %q", bs.Status)
+	}
+
+	if !isNotFound(err) {
+		return fmt.Errorf("could not verify the volume is deleted: %v", err)
+	}
+	return nil
+}
+
+// volumeMatches checks the label and size of the volume
+func volumeMatches(label string, sizeGB int) volumeCheck {
+	return func(bs *govultr.BlockStorage, err error) error {
+		if err := volumeExists(bs, err); err != nil {
+			return err
+		}
+
+		if bs.Label != label {
+			return fmt.Errorf("volume label is %q, expected %q", bs.Label, label)
+		}
+
+		if bs.SizeGB != sizeGB {
+			return fmt.Errorf("volume size is %d GB, expected %d GB", bs.SizeGB, sizeGB)
+		}
+		return nil
+	}
+}
+
+// volumeAttachedTo checks that the volume is attached to the node, or that it
+// is not attached at all when nodeID is empty
+func volumeAttachedTo(nodeID string) volumeCheck {
+	return func(bs *govultr.BlockStorage, err error) error {
+		if err := volumeExists(bs, err); err != nil {
+			return err
+		}
+
+		if bs.AttachedToInstance != nodeID {
+			return fmt.Errorf("volume is attached to %q, expected %q", bs.AttachedToInstance, nodeID)
+		}
+		return nil
+	}
+}
+
+// volumeAttachableTo checks that the volume is either detached or attached to the node
+func volumeAttachableTo(nodeID string) volumeCheck {
+	return func(bs *govultr.BlockStorage, err error) error {
+		if err := volumeExists(bs, err); err != nil {
+			return err
+		}
+
+		if bs.AttachedToInstance != "" && bs.AttachedToInstance != nodeID {
+			return fmt.Errorf("volume is attached to %q, expected %q or no node", bs.AttachedToInstance, nodeID)
+		}
+		return nil
+	}
+}
+
+// volumeAtLeast checks that the volume is at least sizeGB large
+func volumeAtLeast(sizeGB int) volumeCheck {
+	return func(bs *govultr.BlockStorage, err error) error {
+		if err := volumeExists(bs, err); err != nil {
+			return err
+		}
+
+		if bs.SizeGB < sizeGB {
+			return fmt.Errorf("volume size is %d GB, expected at least %d GB", bs.SizeGB, sizeGB)
+		}
+		return nil
+	}
+}
@@ -15,9 +15,37 @@ package driver
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"sync"
+	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/golang/protobuf/ptypes/wrappers"
+	"github.com/sirupsen/logrus"
+	"github.com/vultr/govultr/v2"
+)
+
+// probeCacheTTL is how long a probe result is reused before the API is checked again
+const probeCacheTTL = 10 * time.Second
+
+var (
+	// regionPattern matches Vultr region codes such as ewr
+	regionPattern = regexp.MustCompile(`^[a-z0-9]+$`)
+
+	// pluginServices are the plugin capabilities of the services that are
+	// implemented, CreateVolume and NodeGetInfo report the region topology
+	pluginServices = []csi.PluginCapability_Service_Type{
+		csi.PluginCapability_Service_CONTROLLER_SERVICE,
+		csi.PluginCapability_Service_VOLUME_ACCESSIBILITY_CONSTRAINTS,
+	}
+
+	// pluginVolumeExpansions are the kinds of expansion that are implemented,
+	// volumes are resized while attached
+	pluginVolumeExpansions = []csi.PluginCapability_VolumeExpansion_Type{
+		csi.PluginCapability_VolumeExpansion_ONLINE,
+	}
 )
 
 var _ csi.IdentityServer = &VultrIdentityServer{}
@@ -25,11 +53,15 @@ var _ csi.IdentityServer = &VultrIdentityServer{}
 // VultrIdentityServer provides the Driver
 type VultrIdentityServer struct {
 	Driver *VultrDriver
+
+	probeMu        sync.Mutex
+	probeCheckedAt time.Time
+	probeErr       error
 }
 
 // NewVultrIdentityServer initializes the VultrIdentityServer
 func NewVultrIdentityServer(driver *VultrDriver) *VultrIdentityServer {
-	return &VultrIdentityServer{driver}
+	return &VultrIdentityServer{Driver: driver}
 }
 
 // GetPluginInfo returns basic plugin data
@@ -47,31 +79,84 @@ func (vultrIdentity *VultrIdentityServer) GetPluginInfo(context.Context, *csi.Ge
 func (vultrIdentity *VultrIdentityServer) GetPluginCapabilities(_ context.Context, req *csi.GetPluginCapabilitiesRequest) (*csi.GetPluginCapabilitiesResponse, error) { //nolint:lll
 	vultrIdentity.Driver.log.Infof("VultrIdentityServer.GetPluginCapabilities called with request : %v", req)
 
-	return &csi.GetPluginCapabilitiesResponse{
-		Capabilities: []*csi.PluginCapability{
-			{
-				Type: &csi.PluginCapability_Service_{
-					Service: &csi.PluginCapability_Service{
-						Type: csi.PluginCapability_Service_CONTROLLER_SERVICE,
-					},
+	capabilities := make([]*csi.PluginCapability, 0, len(pluginServices)+len(pluginVolumeExpansions))
+	for _, service := range pluginServices {
+		capabilities = append(capabilities, &csi.PluginCapability{
+			Type: &csi.PluginCapability_Service_{
+				Service: &csi.PluginCapability_Service{
+					Type: service,
 				},
 			},
-			{
-				Type: &csi.PluginCapability_VolumeExpansion_{
-					VolumeExpansion: &csi.PluginCapability_VolumeExpansion{
-						Type: csi.PluginCapability_VolumeExpansion_ONLINE,
-					},
+		})
+	}
+
+	for _, expansion := range pluginVolumeExpansions {
+		capabilities = append(capabilities, &csi.PluginCapability{
+			Type: &csi.PluginCapability_VolumeExpansion_{
+				VolumeExpansion: &csi.PluginCapability_VolumeExpansion{
+					Type: expansion,
 				},
 			},
-		},
+		})
+	}
+
+	return &csi.GetPluginCapabilitiesResponse{
+		Capabilities: capabilities,
 	}, nil
 }
 
-// Probe logs the request
-func (vultrIdentity *VultrIdentityServer) Probe(_ context.Context, req *csi.ProbeRequest) (*csi.ProbeResponse, error) {
+// Probe reports whether the driver is configured and, on the controller, able to reach the Vultr API
+func (vultrIdentity *VultrIdentityServer) Probe(ctx context.Context, req *csi.ProbeRequest) (*csi.ProbeResponse, error) {
 	vultrIdentity.Driver.log.Infof("VultrIdentityServer.Probe called with request : %v", req)
 
+	if err := vultrIdentity.checkHealth(ctx); err != nil {
+		vultrIdentity.Driver.log.WithFields(logrus.Fields{
+			"reason": err.Error(),
+		}).Warn("VultrIdentityServer.Probe not ready")
+
+		return &csi.ProbeResponse{
+			Ready: &wrappers.BoolValue{Value: false},
+		}, nil
+	}
+
 	return &csi.ProbeResponse{
 		Ready: &wrappers.BoolValue{Value: true},
 	}, nil
 }
+
+// checkHealth returns the result of the last health check while it is
+// fresher than probeCacheTTL so frequent probes do not hammer the API
+func (vultrIdentity *VultrIdentityServer) checkHealth(ctx context.Context) error {
+	vultrIdentity.probeMu.Lock()
+	defer vultrIdentity.probeMu.Unlock()
+
+	if !vultrIdentity.probeCheckedAt.IsZero() && time.Since(vultrIdentity.probeCheckedAt) < probeCacheTTL {
+		return vultrIdentity.probeErr
+	}
+
+	vultrIdentity.probeErr = vultrIdentity.Driver.checkHealth(ctx)
+	vultrIdentity.probeCheckedAt = time.Now()
+	return vultrIdentity.probeErr
+}
+
+// checkHealth verifies the region is known and, when running as the
+// controller, that the token is accepted by the API with a cheap list call
+func (d *VultrDriver) checkHealth(ctx context.Context) error {
+	if d.region == "" {
+		return errors.New("region is not configured")
+	}
+
+	if !regionPattern.MatchString(d.region) {
+		return fmt.Errorf("region %q is not a valid Vultr region code", d.region)
+	}
+
+	if !d.isController {
+		return nil
+	}
+
+	if _, _, err := d.client.BlockStorage.List(ctx, &govultr.ListOptions{PerPage: 1}); err != nil {
+		return fmt.Errorf("cannot reach the Vultr API: %v", err)
+	}
+
+	return nil
+}
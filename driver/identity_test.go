@@ -0,0 +1,132 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/vultr/govultr/v2"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// authErrorBS rejects every list with an invalid token error
+type authErrorBS struct {
+	fakeBS
+	lists int
+}
+
+func (f *authErrorBS) List(ctx context.Context, options *govultr.ListOptions) ([]govultr.BlockStorage, *govultr.Meta, error) {
+	f.lists++
+	return nil, nil, errors.New(`{"error":"Invalid API token.","status":401}`)
+}
+
+func TestGetPluginCapabilities(t *testing.T) {
+	controller := NewFakeVultrControllerServer("get plugin capabilities")
+	identity := NewVultrIdentityServer(controller.Driver)
+	ctx := context.Background()
+
+	// each probe checks the feature behind a plugin capability is implemented
+	services := map[csi.PluginCapability_Service_Type]func() bool{
+		csi.PluginCapability_Service_CONTROLLER_SERVICE: func() bool {
+			_, err := controller.DeleteVolume(ctx, &csi.DeleteVolumeRequest{})
+			return status.Code(err) != codes.Unimplemented
+		},
+		csi.PluginCapability_Service_VOLUME_ACCESSIBILITY_CONSTRAINTS: func() bool {
+			res, err := NewFakeVultrNodeServer("get plugin capabilities").NodeGetInfo(ctx, &csi.NodeGetInfoRequest{})
+			return err == nil && res.AccessibleTopology.GetSegments()["region"] != ""
+		},
+	}
+
+	expansions := map[csi.PluginCapability_VolumeExpansion_Type]func() bool{
+		csi.PluginCapability_VolumeExpansion_ONLINE: func() bool {
+			_, err := controller.ControllerExpandVolume(ctx, &csi.ControllerExpandVolumeRequest{})
+			return status.Code(err) != codes.Unimplemented
+		},
+	}
+
+	res, err := identity.GetPluginCapabilities(ctx, &csi.GetPluginCapabilitiesRequest{})
+	if err != nil {
+		t.Fatalf("Expected no error, got error : %v", err)
+	}
+
+	advertised := map[interface{}]bool{}
+	for _, capability := range res.Capabilities {
+		switch {
+		case capability.GetService() != nil:
+			advertised[capability.GetService().GetType()] = true
+		case capability.GetVolumeExpansion() != nil:
+			advertised[capability.GetVolumeExpansion().GetType()] = true
+		default:
+			t.Errorf("unexpected capability %v", capability)
+		}
+	}
+
+	for service, probe := range services {
+		if implemented := probe(); implemented != advertised[service] {
+			t.Errorf("capability %v: advertised %v, implemented %v", service, advertised[service], implemented)
+		}
+	}
+
+	for expansion, probe := range expansions {
+		if implemented := probe(); implemented != advertised[expansion] {
+			t.Errorf("capability %v: advertised %v, implemented %v", expansion, advertised[expansion], implemented)
+		}
+	}
+
+	if len(advertised) != len(services)+len(expansions) {
+		t.Errorf("expected %d capabilities with a probe, got %v", len(services)+len(expansions), res.Capabilities)
+	}
+}
+
+func TestProbe(t *testing.T) {
+	controller := NewFakeVultrControllerServer("probe")
+	identity := NewVultrIdentityServer(controller.Driver)
+
+	res, err := identity.Probe(context.Background(), &csi.ProbeRequest{})
+	if err != nil {
+		t.Fatalf("Expected no error, got error : %v", err)
+	}
+
+	if !res.GetReady().GetValue() {
+		t.Error("Expected driver to be ready")
+	}
+}
+
+func TestProbeAuthError(t *testing.T) {
+	controller := NewFakeVultrControllerServer("probe auth error")
+	bs := &authErrorBS{}
+	controller.Driver.client.BlockStorage = bs
+	identity := NewVultrIdentityServer(controller.Driver)
+
+	for i := 0; i < 2; i++ {
+		res, err := identity.Probe(context.Background(), &csi.ProbeRequest{})
+		if err != nil {
+			t.Fatalf("Expected no error, got error : %v", err)
+		}
+
+		if res.GetReady().GetValue() {
+			t.Error("Expected driver not to be ready with an invalid token")
+		}
+	}
+
+	if bs.lists != 1 {
+		t.Errorf("Expected the probe result to be cached, got %d API calls", bs.lists)
+	}
+}
+
+func TestProbeMissingRegion(t *testing.T) {
+	node := NewFakeVultrNodeServer("probe missing region")
+	node.Driver.region = ""
+	identity := NewVultrIdentityServer(node.Driver)
+
+	res, err := identity.Probe(context.Background(), &csi.ProbeRequest{})
+	if err != nil {
+		t.Fatalf("Expected no error, got error : %v", err)
+	}
+
+	if res.GetReady().GetValue() {
+		t.Error("Expected driver not to be ready without a region")
+	}
+}
@@ -0,0 +1,117 @@
+/*
+Copyright 2020 Vultr Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"sync"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// volumeLocks tracks the volume names and IDs with an operation in flight so
+// a retried request cannot race the original, e.g. creating a second volume
+// while the first is still becoming active
+type volumeLocks struct {
+	mu    sync.Mutex
+	locks map[string]struct{}
+}
+
+func newVolumeLocks() *volumeLocks {
+	return &volumeLocks{locks: make(map[string]struct{})}
+}
+
+// TryAcquire locks key and returns Aborted if it is already locked, the
+// caller must Release the key once its operation is done
+func (l *volumeLocks) TryAcquire(key string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, ok := l.locks[key]; ok {
+		return status.Errorf(codes.Aborted, "an operation for volume %s is already in progress", key)
+	}
+
+	l.locks[key] = struct{}{}
+	return nil
+}
+
+// Release unlocks key
+func (l *volumeLocks) Release(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.locks, key)
+}
+
+// nodeLocks serializes operations against the same node. Unlike volumeLocks
+// a caller waits for the lock, publishing several volumes to one node at once
+// is normal and must not fail.
+type nodeLocks struct {
+	mu    sync.Mutex
+	locks map[string]*nodeLock
+}
+
+type nodeLock struct {
+	held chan struct{}
+	refs int
+}
+
+func newNodeLocks() *nodeLocks {
+	return &nodeLocks{locks: make(map[string]*nodeLock)}
+}
+
+// Acquire waits until key is unlocked and locks it, or returns the context
+// error when ctx is done first. The caller must Release the key once its
+// operation is done.
+func (l *nodeLocks) Acquire(ctx context.Context, key string) error {
+	l.mu.Lock()
+	lock, ok := l.locks[key]
+	if !ok {
+		lock = &nodeLock{held: make(chan struct{}, 1)}
+		l.locks[key] = lock
+	}
+	lock.refs++
+	l.mu.Unlock()
+
+	select {
+	case lock.held <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		l.unref(key, lock)
+		return status.FromContextError(ctx.Err()).Err()
+	}
+}
+
+// Release unlocks key
+func (l *nodeLocks) Release(key string) {
+	l.mu.Lock()
+	lock := l.locks[key]
+	l.mu.Unlock()
+
+	<-lock.held
+	l.unref(key, lock)
+}
+
+// unref drops a reference to the lock and forgets it once nobody holds or
+// waits for it, so nodes that leave the cluster do not accumulate
+func (l *nodeLocks) unref(key string, lock *nodeLock) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	lock.refs--
+	if lock.refs == 0 {
+		delete(l.locks, key)
+	}
+}
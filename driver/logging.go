@@ -0,0 +1,98 @@
+/*
+Copyright 2020 Vultr Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"reflect"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+)
+
+const strippedSecret = "***stripped***"
+
+// loggerKey is the context key of the request scoped logger
+type loggerKey struct{}
+
+// logInterceptor logs every gRPC call with a request ID, the method and the
+// volume and node it targets. The logger carrying these fields is added to the
+// context so the log lines of a call can be correlated, secrets are never logged.
+func (d *VultrDriver) logInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) { //nolint:lll
+	fields := logrus.Fields{
+		"method":     info.FullMethod,
+		"request_id": d.requestID.Add(1),
+	}
+
+	if r, ok := req.(interface{ GetVolumeId() string }); ok && r.GetVolumeId() != "" {
+		fields["volume_id"] = r.GetVolumeId()
+	}
+
+	if r, ok := req.(interface{ GetNodeId() string }); ok && r.GetNodeId() != "" {
+		fields["node_id"] = r.GetNodeId()
+	}
+
+	if r, ok := req.(interface{ GetName() string }); ok && r.GetName() != "" {
+		fields["volume_name"] = r.GetName()
+	}
+
+	logger := d.log.WithFields(fields)
+	logger.WithField("request", stripSecrets(req)).Debug("GRPC request")
+
+	start := time.Now()
+	resp, err := handler(context.WithValue(ctx, loggerKey{}, logger), req)
+
+	logger = logger.WithField("duration", time.Since(start))
+	if err != nil {
+		logger.WithError(err).Error("GRPC call failed")
+	} else {
+		logger.Info("GRPC call succeeded")
+	}
+
+	return resp, err
+}
+
+// logger returns the request scoped logger from ctx, or the driver logger
+// outside of a gRPC call
+func (d *VultrDriver) logger(ctx context.Context) *logrus.Entry {
+	if logger, ok := ctx.Value(loggerKey{}).(*logrus.Entry); ok {
+		return logger
+	}
+	return d.log
+}
+
+// stripSecrets returns a copy of a CSI request with the values of its secrets
+// replaced, the request itself is left untouched
+func stripSecrets(req interface{}) interface{} {
+	msg, ok := req.(proto.Message)
+	if !ok {
+		return req
+	}
+
+	clone := proto.Clone(msg)
+	secrets := reflect.ValueOf(clone).Elem().FieldByName("Secrets")
+	if !secrets.IsValid() || secrets.Kind() != reflect.Map || secrets.Len() == 0 {
+		return clone
+	}
+
+	stripped := reflect.MakeMapWithSize(secrets.Type(), secrets.Len())
+	for _, key := range secrets.MapKeys() {
+		stripped.SetMapIndex(key, reflect.ValueOf(strippedSecret))
+	}
+	secrets.Set(stripped)
+
+	return clone
+}
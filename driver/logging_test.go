@@ -0,0 +1,67 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+)
+
+func TestStripSecrets(t *testing.T) {
+	req := &csi.NodeStageVolumeRequest{
+		VolumeId: "c56c7b6e-15c2-445e-9a5d-1063ab5828ec",
+		Secrets:  map[string]string{encryptionPassphraseKey: "hunter2"},
+	}
+
+	stripped := fmt.Sprintf("%v", stripSecrets(req))
+	if strings.Contains(stripped, "hunter2") {
+		t.Errorf("expected secret to be stripped from %s", stripped)
+	}
+
+	if !strings.Contains(stripped, req.VolumeId) {
+		t.Errorf("expected the rest of the request to be kept in %s", stripped)
+	}
+
+	if req.Secrets[encryptionPassphraseKey] != "hunter2" {
+		t.Error("expected the original request to be left untouched")
+	}
+}
+
+func TestLogInterceptor(t *testing.T) {
+	d := &VultrDriver{log: logrus.New().WithFields(logrus.Fields{"test": "log interceptor"})}
+	info := &grpc.UnaryServerInfo{FullMethod: "/csi.v1.Controller/ControllerPublishVolume"}
+	req := &csi.ControllerPublishVolumeRequest{
+		VolumeId: "c56c7b6e-15c2-445e-9a5d-1063ab5828ec",
+		NodeId:   "245bb2fe-b55c-44a0-9a1e-ab80e4b5f088",
+	}
+
+	var fields logrus.Fields
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		fields = d.logger(ctx).Data
+		return &csi.ControllerPublishVolumeResponse{}, nil
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := d.logInterceptor(context.Background(), req, info, handler); err != nil {
+			t.Fatalf("Expected no error, got error : %v", err)
+		}
+	}
+
+	expected := logrus.Fields{
+		"test":       "log interceptor",
+		"method":     info.FullMethod,
+		"request_id": uint64(2),
+		"volume_id":  req.VolumeId,
+		"node_id":    req.NodeId,
+	}
+
+	for key, value := range expected {
+		if fields[key] != value {
+			t.Errorf("expected %s %v in the request logger, got %v", key, value, fields[key])
+		}
+	}
+}
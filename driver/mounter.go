@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"syscall"
@@ -17,6 +18,8 @@ const (
 	runningState                 = "running"
 	blkidExitStatusNoIdentifiers = 2
 	mkDirMode                    = 0750
+	mkFileMode                   = 0640
+	luksMapperPath               = "/dev/mapper"
 )
 
 // Mounter is the type interface for the mounter
@@ -24,10 +27,23 @@ type Mounter interface {
 	Format(source, fs string) error
 	IsFormatted(source string) (bool, error)
 	Mount(source, target, fs string, opts ...string) error
+	MountBlock(source, target string, opts ...string) error
 	IsMounted(target string) (bool, error)
 	UnMount(target string) error
 	GetStatistics(target string) (volumeStatistics, error)
 	IsBlockDevice(target string) (bool, error)
+	PathExists(path string) (bool, error)
+	RemovePath(path string) error
+	FindMount(target string) (source, fs string, err error)
+	GetDeviceSize(device string) (int64, error)
+	Resize(source, target, fs string) error
+	IsLuks(device string) (bool, error)
+	LuksFormat(device, passphrase string) error
+	LuksOpen(device, name, passphrase string) error
+	LuksClose(name string) error
+	IsLuksOpen(name string) (bool, error)
+	LuksDevice(name string) (string, error)
+	LuksResize(name, passphrase string) error
 }
 
 type volumeStatistics struct {
@@ -180,6 +196,44 @@ func (m *mounter) Mount(source, target, fs string, opts ...string) error {
 	return nil
 }
 
+// MountBlock bind mounts the block device source onto the file target,
+// creating the file if it does not exist
+func (m *mounter) MountBlock(source, target string, opts ...string) error {
+	if source == "" {
+		return errors.New("source type was not provided - required for mounting")
+	}
+
+	if target == "" {
+		return errors.New("target type was not provided - required for mounting")
+	}
+
+	if err := os.MkdirAll(filepath.Dir(target), mkDirMode); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(target, os.O_CREATE, mkFileMode)
+	if err != nil {
+		return err
+	}
+	file.Close()
+
+	mountCommand := "mount"
+	mountArguments := []string{"-o", strings.Join(append([]string{"bind"}, opts...), ","), source, target}
+
+	m.log.WithFields(logrus.Fields{
+		"mount command":   mountCommand,
+		"mount arguments": mountArguments,
+	}).Info("mount block command and arguments")
+
+	out, err := exec.Command(mountCommand, mountArguments...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("mounting failed: %v cmd: '%s %s' output: %q",
+			err, mountCommand, strings.Join(mountArguments, " "), string(out))
+	}
+
+	return nil
+}
+
 func (m *mounter) IsMounted(target string) (bool, error) {
 	if target == "" {
 		return false, errors.New("target path was not provided")
@@ -245,15 +299,9 @@ func (m *mounter) GetStatistics(target string) (volumeStatistics, error) {
 	}
 
 	if isBlock {
-		output, errCommand := exec.Command("blockdev", "getsize64", target).CombinedOutput()
-		if errCommand != nil {
-			errFmt := fmt.Errorf("error when getting size of block volume at path %s: output: %s, err: %v", target, string(output), err)
-			return volumeStatistics{}, errFmt
-		}
-		strOut := strings.TrimSpace(string(output))
-		gotSizeBytes, errParse := strconv.ParseInt(strOut, 10, 64)
-		if errParse != nil {
-			return volumeStatistics{}, fmt.Errorf("failed to parse size %s into int", strOut)
+		gotSizeBytes, errSize := m.GetDeviceSize(target)
+		if errSize != nil {
+			return volumeStatistics{}, errSize
 		}
 
 		return volumeStatistics{
@@ -289,3 +337,178 @@ func (m *mounter) IsBlockDevice(devicePath string) (bool, error) {
 
 	return (stat.Mode & unix.S_IFMT) == unix.S_IFBLK, nil
 }
+
+func (m *mounter) PathExists(path string) (bool, error) {
+	if _, err := os.Stat(path); err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return true, nil
+}
+
+// RemovePath removes an unmounted target, a directory that is not empty is
+// never removed as it may still hold volume data
+func (m *mounter) RemovePath(path string) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+func (m *mounter) FindMount(target string) (source, fs string, err error) {
+	if target == "" {
+		return "", "", errors.New("target path was not provided")
+	}
+
+	findmntCmd := "findmnt"
+	cmdArgs := []string{"-n", "-o", "SOURCE,FSTYPE", "-M", target}
+	out, err := exec.Command(findmntCmd, cmdArgs...).CombinedOutput()
+	if err != nil {
+		return "", "", fmt.Errorf("finding mount failed: %v cmd: '%s %s' output: %q",
+			err, findmntCmd, strings.Join(cmdArgs, " "), string(out))
+	}
+
+	fields := strings.Fields(string(out))
+	if len(fields) != 2 {
+		return "", "", fmt.Errorf("unexpected findmnt output for %s: %q", target, string(out))
+	}
+
+	return fields[0], fields[1], nil
+}
+
+func (m *mounter) GetDeviceSize(device string) (int64, error) {
+	output, err := exec.Command("blockdev", "--getsize64", device).CombinedOutput()
+	if err != nil {
+		return 0, fmt.Errorf("error when getting size of block device %s: output: %s, err: %v", device, string(output), err)
+	}
+
+	strOut := strings.TrimSpace(string(output))
+	gotSizeBytes, err := strconv.ParseInt(strOut, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse size %s into int", strOut)
+	}
+
+	return gotSizeBytes, nil
+}
+
+func (m *mounter) Resize(source, target, fs string) error {
+	var resizeCmd string
+	var resizeArgs []string
+
+	switch fs {
+	case "ext3", "ext4":
+		resizeCmd = "resize2fs"
+		resizeArgs = []string{source}
+	case "xfs":
+		resizeCmd = "xfs_growfs"
+		resizeArgs = []string{target}
+	default:
+		return fmt.Errorf("resizing %s filesystems is not supported", fs)
+	}
+
+	m.log.WithFields(logrus.Fields{
+		"cmd":  resizeCmd,
+		"args": resizeArgs,
+	}).Info("executing resize command")
+
+	out, err := exec.Command(resizeCmd, resizeArgs...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("resizing failed: %v cmd: '%s %s' output: %q",
+			err, resizeCmd, strings.Join(resizeArgs, " "), string(out))
+	}
+
+	return nil
+}
+
+func (m *mounter) IsLuks(device string) (bool, error) {
+	if device == "" {
+		return false, errors.New("device was not provided")
+	}
+
+	err := exec.Command("cryptsetup", "isLuks", device).Run()
+	if err != nil {
+		if _, ok := err.(*exec.ExitError); ok {
+			return false, nil
+		}
+		return false, fmt.Errorf("checking for LUKS header failed: %v", err)
+	}
+
+	return true, nil
+}
+
+func (m *mounter) LuksFormat(device, passphrase string) error {
+	m.log.WithFields(logrus.Fields{
+		"device": device,
+	}).Info("LuksFormat called")
+
+	return runCryptsetup(passphrase, "-q", "luksFormat", "--type", "luks2", "--key-file", "-", device)
+}
+
+func (m *mounter) LuksOpen(device, name, passphrase string) error {
+	m.log.WithFields(logrus.Fields{
+		"device": device,
+		"name":   name,
+	}).Info("LuksOpen called")
+
+	return runCryptsetup(passphrase, "luksOpen", "--key-file", "-", device, name)
+}
+
+func (m *mounter) LuksClose(name string) error {
+	m.log.WithFields(logrus.Fields{
+		"name": name,
+	}).Info("LuksClose called")
+
+	return runCryptsetup("", "luksClose", name)
+}
+
+func (m *mounter) IsLuksOpen(name string) (bool, error) {
+	return m.PathExists(filepath.Join(luksMapperPath, name))
+}
+
+// LuksDevice returns the device backing an open LUKS mapper
+func (m *mounter) LuksDevice(name string) (string, error) {
+	out, err := exec.Command("cryptsetup", "status", name).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("cryptsetup failed: %v cmd: 'cryptsetup status %s' output: %q", err, name, string(out))
+	}
+
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == "device:" {
+			return fields[1], nil
+		}
+	}
+
+	return "", fmt.Errorf("no device found in cryptsetup status of %s", name)
+}
+
+// LuksResize grows an open LUKS mapper to the size of its device, LUKS2
+// keeps the volume key in the kernel keyring and needs the passphrase then
+func (m *mounter) LuksResize(name, passphrase string) error {
+	m.log.WithFields(logrus.Fields{
+		"name": name,
+	}).Info("LuksResize called")
+
+	if passphrase == "" {
+		return runCryptsetup("", "resize", name)
+	}
+	return runCryptsetup(passphrase, "resize", "--key-file", "-", name)
+}
+
+// runCryptsetup runs cryptsetup with the passphrase on stdin so it never
+// shows up in the process list or the logs
+func runCryptsetup(passphrase string, args ...string) error {
+	cmd := exec.Command("cryptsetup", args...)
+	cmd.Stdin = strings.NewReader(passphrase)
+
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("cryptsetup failed: %v cmd: 'cryptsetup %s' output: %q", err, strings.Join(args, " "), string(out))
+	}
+
+	return nil
+}
@@ -4,6 +4,8 @@ import (
 	"context"
 	"fmt"
 	"path/filepath"
+	"strings"
+	"time"
 
 	csi "github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/sirupsen/logrus"
@@ -15,12 +17,31 @@ const (
 	diskPath   = "/dev/disk/by-id"
 	diskPrefix = "virtio-"
 
-	maxVolumesPerNode = 16
+	// encryptionPassphraseKey is the node stage secret holding the LUKS passphrase
+	encryptionPassphraseKey = "encryptionPassphrase"
+	luksMapperPrefix        = "luks-"
+
+	// ephemeralKey is the volume context key kubelet sets for inline ephemeral volumes
+	ephemeralKey = "csi.storage.k8s.io/ephemeral"
 
 	volumeModeBlock      = "block"
 	volumeModeFilesystem = "filesystem"
 )
 
+// conflictingMountFlags pairs mount flags that cannot be requested together,
+// in the order they are checked
+var conflictingMountFlags = [][2]string{
+	{"ro", "rw"},
+	{"atime", "noatime"},
+	{"relatime", "norelatime"},
+	{"diratime", "nodiratime"},
+	{"discard", "nodiscard"},
+	{"exec", "noexec"},
+	{"suid", "nosuid"},
+	{"dev", "nodev"},
+	{"sync", "async"},
+}
+
 var _ csi.NodeServer = &VultrNodeServer{}
 
 // VultrNodeServer type provides the VultrDriver
@@ -47,27 +68,78 @@ func (n *VultrNodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStag
 		return nil, status.Error(codes.InvalidArgument, "NodeStageVolume Volume Capability must be provided")
 	}
 
-	n.Driver.log.WithFields(logrus.Fields{
+	n.Driver.logger(ctx).WithFields(logrus.Fields{
 		"volume":   req.VolumeId,
 		"target":   req.StagingTargetPath,
 		"capacity": req.VolumeCapability,
 	}).Info("Node Stage Volume: called")
 
-	volumeID, ok := req.GetPublishContext()[n.Driver.mountID]
-	if !ok {
-		return nil, status.Error(codes.InvalidArgument, "Could not find the volume id")
+	volumeID := req.GetPublishContext()[n.Driver.mountID]
+	if volumeID == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "NodeStageVolume publish context is missing %q, the device cannot be found",
+			n.Driver.mountID)
 	}
 
 	source := getDeviceByPath(volumeID)
 	target := req.StagingTargetPath
+	encrypted := req.GetVolumeContext()[encryptedKey] == "true"
+
+	if encrypted && req.VolumeCapability.GetBlock() != nil {
+		return nil, status.Error(codes.InvalidArgument, "NodeStageVolume encryption is not supported for block volumes")
+	}
+
+	if err := n.waitForDevice(ctx, source, volumeID); err != nil {
+		return nil, err
+	}
+
+	// raw block volumes are bind mounted straight from the device on publish,
+	// there is no filesystem to create or mount
+	if req.VolumeCapability.GetBlock() != nil {
+		n.Driver.logger(ctx).WithFields(logrus.Fields{
+			"source":      source,
+			"volume_mode": volumeModeBlock,
+		}).Info("Node Stage Volume: block volume staged")
+		return &csi.NodeStageVolumeResponse{}, nil
+	}
+
 	mount := req.VolumeCapability.GetMount()
 	options := mount.MountFlags
+	if err := validateMountFlags(options); err != nil {
+		return nil, err
+	}
 
-	fsTpe := "ext4"
-	if mount.FsType != "" {
+	// volumes created before fsType was recorded keep defaulting to ext4
+	fsTpe := defaultFsType
+	if fsType := req.GetVolumeContext()[fsTypeKey]; fsType != "" {
+		fsTpe = fsType
+	} else if mount.FsType != "" {
 		fsTpe = mount.FsType
 	}
 
+	if !isSupportedFsType(fsTpe) {
+		return nil, status.Errorf(codes.InvalidArgument, "NodeStageVolume fs type %q is not supported, must be one of: %s",
+			fsTpe, strings.Join(supportedFsTypes, ", "))
+	}
+
+	// a restaged volume is already formatted and mounted, leave it untouched
+	mounted, err := n.Driver.mounter.IsMounted(target)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	if mounted {
+		n.Driver.logger(ctx).Info("Node Stage Volume: volume already staged")
+		return &csi.NodeStageVolumeResponse{}, nil
+	}
+
+	if encrypted {
+		mapper, err := n.openEncryptedVolume(req.VolumeId, source, req.GetSecrets())
+		if err != nil {
+			return nil, err
+		}
+		source = mapper
+	}
+
 	formatted, err := n.Driver.mounter.IsFormatted(source)
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "cannot verify if formatted: %v", err.Error())
@@ -75,7 +147,7 @@ func (n *VultrNodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStag
 
 	if !formatted {
 		if err = n.Driver.mounter.Format(source, fsTpe); err != nil {
-			n.Driver.log.WithFields(logrus.Fields{
+			n.Driver.logger(ctx).WithFields(logrus.Fields{
 				"source": source,
 				"fs":     fsTpe,
 				"method": "node-stage-method",
@@ -84,18 +156,11 @@ func (n *VultrNodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStag
 		}
 	}
 
-	mounted, err := n.Driver.mounter.IsMounted(target)
-	if err != nil {
+	if err := n.Driver.mounter.Mount(source, target, fsTpe, options...); err != nil {
 		return nil, status.Error(codes.Internal, err.Error())
 	}
 
-	if !mounted {
-		if err := n.Driver.mounter.Mount(source, target, fsTpe, options...); err != nil {
-			return nil, status.Error(codes.Internal, err.Error())
-		}
-	}
-
-	n.Driver.log.Info("Node Stage Volume: volume staged")
+	n.Driver.logger(ctx).Info("Node Stage Volume: volume staged")
 	return &csi.NodeStageVolumeResponse{}, nil
 }
 
@@ -109,7 +174,7 @@ func (n *VultrNodeServer) NodeUnstageVolume(ctx context.Context, req *csi.NodeUn
 		return nil, status.Error(codes.InvalidArgument, "Staging Target Path must be provided")
 	}
 
-	n.Driver.log.WithFields(logrus.Fields{
+	n.Driver.logger(ctx).WithFields(logrus.Fields{
 		"volume-id":           req.VolumeId,
 		"staging-target-path": req.StagingTargetPath,
 	}).Info("Node Unstage Volume: called")
@@ -120,13 +185,26 @@ func (n *VultrNodeServer) NodeUnstageVolume(ctx context.Context, req *csi.NodeUn
 	}
 
 	if mounted {
-		err := n.Driver.mounter.UnMount(req.StagingTargetPath)
-		if err != nil {
-			return nil, err
+		if err := n.Driver.mounter.UnMount(req.StagingTargetPath); err != nil {
+			return nil, status.Errorf(codes.Internal, "cannot unmount %s: %v", req.StagingTargetPath, err)
+		}
+	}
+
+	// the volume context is not available here, an open mapper device is what
+	// marks the volume as encrypted
+	name := luksMapperPrefix + req.VolumeId
+	open, err := n.Driver.mounter.IsLuksOpen(name)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot verify if LUKS device %s is open: %v", name, err)
+	}
+
+	if open {
+		if err := n.Driver.mounter.LuksClose(name); err != nil {
+			return nil, status.Errorf(codes.Internal, "cannot close LUKS device %s: %v", name, err)
 		}
 	}
 
-	n.Driver.log.Info("Node Unstage Volume: volume unstaged")
+	n.Driver.logger(ctx).Info("Node Unstage Volume: volume unstaged")
 	return &csi.NodeUnstageVolumeResponse{}, nil
 }
 
@@ -136,6 +214,12 @@ func (n *VultrNodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePu
 		return nil, status.Error(codes.InvalidArgument, "VolumeID must be provided")
 	}
 
+	// the node plugin has no API token to create a volume with, inline volumes
+	// are only reachable if the CSIDriver object is changed to allow them
+	if req.GetVolumeContext()[ephemeralKey] == "true" {
+		return nil, status.Error(codes.InvalidArgument, "ephemeral inline volumes are not supported, use a PersistentVolumeClaim")
+	}
+
 	if req.StagingTargetPath == "" {
 		return nil, status.Error(codes.InvalidArgument, "Staging Target Path must be provided")
 	}
@@ -144,31 +228,60 @@ func (n *VultrNodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePu
 		return nil, status.Error(codes.InvalidArgument, "Target Path must be provided")
 	}
 
-	log := n.Driver.log.WithFields(logrus.Fields{
+	if req.VolumeCapability == nil {
+		return nil, status.Error(codes.InvalidArgument, "Volume Capability must be provided")
+	}
+
+	log := n.Driver.logger(ctx).WithFields(logrus.Fields{
 		"volume_id":           req.VolumeId,
 		"staging_target_path": req.StagingTargetPath,
 		"target_path":         req.TargetPath,
 	})
 	log.Info("Node Publish Volume: called")
 
+	if req.VolumeCapability.GetBlock() != nil {
+		return n.publishBlockVolume(ctx, req)
+	}
+
+	mnt := req.VolumeCapability.GetMount()
+	if err := validateMountFlags(mnt.MountFlags); err != nil {
+		return nil, err
+	}
+
+	// a readonly publish takes precedence over rw from the StorageClass
 	options := []string{"bind"}
+	for _, flag := range mnt.MountFlags {
+		if req.Readonly && flag == "rw" {
+			continue
+		}
+		options = append(options, flag)
+	}
+
 	if req.Readonly {
 		options = append(options, "ro")
 	}
 
-	mnt := req.VolumeCapability.GetMount()
-	options = append(options, mnt.MountFlags...)
-
 	fsType := "ext4"
 	if mnt.FsType != "" {
 		fsType = mnt.FsType
 	}
 
-	mounted, err := n.Driver.mounter.IsMounted(req.TargetPath)
+	// bind mounting an unstaged path would hide the volume behind an empty directory
+	staged, err := n.Driver.mounter.IsMounted(req.StagingTargetPath)
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "cannot verify mount status for %v, %v", req.StagingTargetPath, err.Error())
 	}
 
+	if !staged {
+		return nil, status.Errorf(codes.FailedPrecondition,
+			"staging target path %v is not mounted, volume must be staged first", req.StagingTargetPath)
+	}
+
+	mounted, err := n.Driver.mounter.IsMounted(req.TargetPath)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot verify mount status for %v, %v", req.TargetPath, err.Error())
+	}
+
 	if !mounted {
 		err := n.Driver.mounter.Mount(req.StagingTargetPath, req.TargetPath, fsType, options...)
 		if err != nil {
@@ -176,7 +289,40 @@ func (n *VultrNodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePu
 		}
 	}
 
-	n.Driver.log.Info("Node Publish Volume: published")
+	n.Driver.logger(ctx).Info("Node Publish Volume: published")
+	return &csi.NodePublishVolumeResponse{}, nil
+}
+
+// publishBlockVolume bind mounts the raw device onto the target path
+func (n *VultrNodeServer) publishBlockVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
+	volumeID, ok := req.GetPublishContext()[n.Driver.mountID]
+	if !ok {
+		return nil, status.Error(codes.InvalidArgument, "Could not find the volume id")
+	}
+
+	source := getDeviceByPath(volumeID)
+
+	var options []string
+	if req.Readonly {
+		options = append(options, "ro")
+	}
+
+	mounted, err := n.Driver.mounter.IsMounted(req.TargetPath)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot verify mount status for %v, %v", req.TargetPath, err.Error())
+	}
+
+	if !mounted {
+		if err := n.Driver.mounter.MountBlock(source, req.TargetPath, options...); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	n.Driver.logger(ctx).WithFields(logrus.Fields{
+		"source":      source,
+		"target_path": req.TargetPath,
+		"volume_mode": volumeModeBlock,
+	}).Info("Node Publish Volume: block volume published")
 	return &csi.NodePublishVolumeResponse{}, nil
 }
 
@@ -190,7 +336,7 @@ func (n *VultrNodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.Node
 		return nil, status.Error(codes.InvalidArgument, "Target Path must be provided")
 	}
 
-	n.Driver.log.WithFields(logrus.Fields{
+	n.Driver.logger(ctx).WithFields(logrus.Fields{
 		"volume-id":   req.VolumeId,
 		"target-path": req.TargetPath,
 	}).Info("Node Unpublish Volume: called")
@@ -201,13 +347,17 @@ func (n *VultrNodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.Node
 	}
 
 	if mounted {
-		err := n.Driver.mounter.UnMount(req.TargetPath)
-		if err != nil {
-			return nil, err
+		if err := n.Driver.mounter.UnMount(req.TargetPath); err != nil {
+			return nil, status.Errorf(codes.Internal, "cannot unmount %s: %v", req.TargetPath, err)
 		}
 	}
 
-	n.Driver.log.Info("Node Publish Volume: unpublished")
+	// kubelet expects the target path to be gone once the volume is unpublished
+	if err := n.Driver.mounter.RemovePath(req.TargetPath); err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot remove target path %s: %v", req.TargetPath, err)
+	}
+
+	n.Driver.logger(ctx).Info("Node Publish Volume: unpublished")
 	return &csi.NodeUnpublishVolumeResponse{}, nil
 }
 
@@ -222,13 +372,22 @@ func (n *VultrNodeServer) NodeGetVolumeStats(ctx context.Context, req *csi.NodeG
 		return nil, status.Error(codes.InvalidArgument, "NodeGetVolumeStats Volume Path must be provided")
 	}
 
-	log := n.Driver.log.WithFields(logrus.Fields{
+	log := n.Driver.logger(ctx).WithFields(logrus.Fields{
 		"volume_id":   req.VolumeId,
 		"volume_path": req.VolumePath,
 		"method":      "node_get_volume_stats",
 	})
 	log.Info("node get volume stats called")
 
+	exists, err := n.Driver.mounter.PathExists(volumePath)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to check if volume path %q exists: %s", volumePath, err)
+	}
+
+	if !exists {
+		return nil, status.Errorf(codes.NotFound, "volume path %q does not exist", volumePath)
+	}
+
 	mounted, err := n.Driver.mounter.IsMounted(volumePath)
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "failed to check if volume path %q is mounted: %s", volumePath, err)
@@ -295,15 +454,150 @@ func (n *VultrNodeServer) NodeGetVolumeStats(ctx context.Context, req *csi.NodeG
 
 // NodeExpandVolume provides the node volume expansion
 func (n *VultrNodeServer) NodeExpandVolume(ctx context.Context, req *csi.NodeExpandVolumeRequest) (*csi.NodeExpandVolumeResponse, error) {
-	n.Driver.log.WithFields(logrus.Fields{
-		"required_bytes": req.CapacityRange.RequiredBytes,
-	}).Info("Node Expand Volume: called")
+	if req.VolumeId == "" {
+		return nil, status.Error(codes.InvalidArgument, "NodeExpandVolume Volume ID must be provided")
+	}
+
+	volumePath := req.VolumePath
+	if volumePath == "" {
+		return nil, status.Error(codes.InvalidArgument, "NodeExpandVolume Volume Path must be provided")
+	}
+
+	log := n.Driver.logger(ctx).WithFields(logrus.Fields{
+		"volume_id":      req.VolumeId,
+		"volume_path":    volumePath,
+		"required_bytes": req.GetCapacityRange().GetRequiredBytes(),
+	})
+	log.Info("Node Expand Volume: called")
+
+	mounted, err := n.Driver.mounter.IsMounted(volumePath)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to check if volume path %q is mounted: %s", volumePath, err)
+	}
+
+	if !mounted {
+		return nil, status.Errorf(codes.NotFound, "volume path %q is not mounted", volumePath)
+	}
+
+	isBlock, err := n.Driver.mounter.IsBlockDevice(volumePath)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to determine if %q is block device: %s", volumePath, err)
+	}
+
+	// raw block volumes have no filesystem to grow, the device size is all there is
+	if isBlock || req.GetVolumeCapability().GetBlock() != nil {
+		log.Info("Node Expand Volume: block volume, nothing to resize")
+		return &csi.NodeExpandVolumeResponse{}, nil
+	}
+
+	source, fs, err := n.Driver.mounter.FindMount(volumePath)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to find device for volume path %q: %s", volumePath, err)
+	}
+
+	// an encrypted volume is mounted from its mapper, which is smaller than
+	// the disk by the LUKS header and only grows once the disk has
+	device := source
+	name := luksMapperPrefix + req.VolumeId
+	encrypted := source == filepath.Join(luksMapperPath, name)
+	if encrypted {
+		if device, err = n.Driver.mounter.LuksDevice(name); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to find device of LUKS device %s: %s", name, err)
+		}
+	}
+
+	size, err := n.waitForDeviceSize(ctx, device, req.GetCapacityRange().GetRequiredBytes())
+	if err != nil {
+		return nil, err
+	}
+
+	if encrypted {
+		if err := n.Driver.mounter.LuksResize(name, req.GetSecrets()[encryptionPassphraseKey]); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to resize LUKS device %s: %s", name, err)
+		}
+	}
+
+	if err := n.Driver.mounter.Resize(source, volumePath, fs); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to resize %s filesystem on %s: %s", fs, source, err)
+	}
+
+	log.WithFields(logrus.Fields{
+		"device":         source,
+		"fs":             fs,
+		"capacity_bytes": size,
+	}).Info("Node Expand Volume: filesystem resized")
 
 	return &csi.NodeExpandVolumeResponse{
-		CapacityBytes: req.CapacityRange.RequiredBytes,
+		CapacityBytes: size,
 	}, nil
 }
 
+// waitForDeviceSize waits for the device to reflect at least the required
+// size, the kernel can lag behind the controller side resize
+func (n *VultrNodeServer) waitForDeviceSize(ctx context.Context, device string, required int64) (int64, error) {
+	interval := n.Driver.statusCheckInterval
+	for i := 0; ; i++ {
+		size, err := n.Driver.mounter.GetDeviceSize(device)
+		if err != nil {
+			return 0, status.Errorf(codes.Internal, "failed to get size of device %s: %s", device, err)
+		}
+
+		if size >= required {
+			return size, nil
+		}
+
+		if i >= n.Driver.statusCheckRetries {
+			return 0, status.Errorf(codes.Internal, "device %s is %d bytes, expected at least %d after %d status checks",
+				device, size, required, n.Driver.statusCheckRetries)
+		}
+
+		select {
+		case <-ctx.Done():
+			return 0, status.FromContextError(ctx.Err()).Err()
+		case <-time.After(interval):
+		}
+
+		interval *= 2
+		if interval > n.Driver.statusCheckMaxInterval {
+			interval = n.Driver.statusCheckMaxInterval
+		}
+	}
+}
+
+// waitForDevice polls until the device of an attached volume shows up on the
+// node, the kernel can take a few seconds to add it after the attach
+func (n *VultrNodeServer) waitForDevice(ctx context.Context, device, volumeID string) error {
+	interval := n.Driver.statusCheckInterval
+	for i := 0; ; i++ {
+		exists, err := n.Driver.mounter.PathExists(device)
+		if err != nil {
+			return status.Errorf(codes.Internal, "failed to check for device %s: %s", device, err)
+		}
+
+		if exists {
+			return nil
+		}
+
+		if i >= n.Driver.statusCheckRetries {
+			return status.Errorf(codes.Internal, "device %s for disk %s did not appear after %d status checks",
+				device, volumeID, n.Driver.statusCheckRetries)
+		}
+
+		n.Driver.logger(ctx).WithField("device", device).Debug("Node Stage Volume: waiting for device")
+
+		select {
+		case <-ctx.Done():
+			return status.FromContextError(ctx.Err()).Err()
+		case <-time.After(interval):
+		}
+
+		interval *= 2
+		if interval > n.Driver.statusCheckMaxInterval {
+			interval = n.Driver.statusCheckMaxInterval
+		}
+	}
+}
+
 // NodeGetCapabilities provides the node capabilities
 func (n *VultrNodeServer) NodeGetCapabilities(context.Context, *csi.NodeGetCapabilitiesRequest) (*csi.NodeGetCapabilitiesResponse, error) {
 	nodeCapabilities := []*csi.NodeServiceCapability{
@@ -328,6 +622,13 @@ func (n *VultrNodeServer) NodeGetCapabilities(context.Context, *csi.NodeGetCapab
 				},
 			},
 		},
+		{
+			Type: &csi.NodeServiceCapability_Rpc{
+				Rpc: &csi.NodeServiceCapability_RPC{
+					Type: csi.NodeServiceCapability_RPC_SINGLE_NODE_MULTI_WRITER,
+				},
+			},
+		},
 	}
 
 	n.Driver.log.WithFields(logrus.Fields{
@@ -341,11 +642,11 @@ func (n *VultrNodeServer) NodeGetCapabilities(context.Context, *csi.NodeGetCapab
 
 // NodeGetInfo provides the node info
 func (n *VultrNodeServer) NodeGetInfo(ctx context.Context, req *csi.NodeGetInfoRequest) (*csi.NodeGetInfoResponse, error) {
-	n.Driver.log.WithFields(logrus.Fields{}).Info("Node Get Info: called")
+	n.Driver.logger(ctx).WithFields(logrus.Fields{}).Info("Node Get Info: called")
 
 	return &csi.NodeGetInfoResponse{
 		NodeId:            n.Driver.nodeID,
-		MaxVolumesPerNode: maxVolumesPerNode,
+		MaxVolumesPerNode: int64(n.Driver.maxVolumesPerNode),
 		AccessibleTopology: &csi.Topology{
 			Segments: map[string]string{
 				"region": n.Driver.region,
@@ -354,6 +655,74 @@ func (n *VultrNodeServer) NodeGetInfo(ctx context.Context, req *csi.NodeGetInfoR
 	}, nil
 }
 
+// openEncryptedVolume opens the LUKS container on device, creating it on first
+// use, and returns the path of the decrypted mapper device
+func (n *VultrNodeServer) openEncryptedVolume(volumeID, device string, secrets map[string]string) (string, error) {
+	passphrase := secrets[encryptionPassphraseKey]
+	if passphrase == "" {
+		return "", status.Errorf(codes.InvalidArgument, "NodeStageVolume encrypted volume requires the %q node stage secret", encryptionPassphraseKey)
+	}
+
+	name := luksMapperPrefix + volumeID
+	mapper := filepath.Join(luksMapperPath, name)
+
+	open, err := n.Driver.mounter.IsLuksOpen(name)
+	if err != nil {
+		return "", status.Errorf(codes.Internal, "cannot verify if LUKS device %s is open: %v", name, err)
+	}
+
+	if open {
+		return mapper, nil
+	}
+
+	isLuks, err := n.Driver.mounter.IsLuks(device)
+	if err != nil {
+		return "", status.Errorf(codes.Internal, "cannot verify if %s is encrypted: %v", device, err)
+	}
+
+	if !isLuks {
+		// never encrypt over data that was written unencrypted
+		formatted, err := n.Driver.mounter.IsFormatted(device)
+		if err != nil {
+			return "", status.Errorf(codes.Internal, "cannot verify if formatted: %v", err)
+		}
+
+		if formatted {
+			return "", status.Errorf(codes.FailedPrecondition, "device %s already has an unencrypted filesystem", device)
+		}
+
+		if err := n.Driver.mounter.LuksFormat(device, passphrase); err != nil {
+			return "", status.Errorf(codes.Internal, "cannot encrypt %s: %v", device, err)
+		}
+	}
+
+	if err := n.Driver.mounter.LuksOpen(device, name, passphrase); err != nil {
+		return "", status.Errorf(codes.Internal, "cannot open LUKS device %s: %v", device, err)
+	}
+
+	return mapper, nil
+}
+
+// validateMountFlags rejects flags that would be mangled when joined into the
+// mount options string and pairs of flags that contradict each other
+func validateMountFlags(flags []string) error {
+	seen := make(map[string]bool, len(flags))
+	for _, flag := range flags {
+		if flag == "" || strings.ContainsAny(flag, ", \t\n") {
+			return status.Errorf(codes.InvalidArgument, "mount flag %q is invalid", flag)
+		}
+		seen[flag] = true
+	}
+
+	for _, pair := range conflictingMountFlags {
+		if seen[pair[0]] && seen[pair[1]] {
+			return status.Errorf(codes.InvalidArgument, "mount flag %q conflicts with %q", pair[0], pair[1])
+		}
+	}
+
+	return nil
+}
+
 func getDeviceByPath(volumeID string) string {
 	return filepath.Join(diskPath, fmt.Sprintf("%s%s", diskPrefix, volumeID))
 }
@@ -0,0 +1,826 @@
+package driver
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func NewFakeVultrNodeServer(testName string) *VultrNodeServer {
+	log := logrus.New().WithFields(logrus.Fields{
+		"test": testName,
+	})
+
+	d := &VultrDriver{
+		nodeID:  "245bb2fe-b55c-44a0-9a1e-ab80e4b5f088",
+		region:  "ewr",
+		log:     log,
+		mounter: NewFakeMounter(log),
+
+		statusCheckRetries:     DefaultVolumeStatusCheckRetries,
+		statusCheckInterval:    time.Millisecond,
+		statusCheckMaxInterval: 10 * time.Millisecond,
+
+		maxVolumesPerNode: DefaultMaxVolumesPerNode,
+	}
+
+	return NewVultrNodeDriver(d)
+}
+
+func mountVolumeCapability() *csi.VolumeCapability {
+	return &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{
+			Mount: &csi.VolumeCapability_MountVolume{},
+		},
+		AccessMode: &csi.VolumeCapability_AccessMode{
+			Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+		},
+	}
+}
+
+func TestNodePublishVolume(t *testing.T) {
+	node := NewFakeVultrNodeServer("node publish volume")
+	stagingPath := "/var/lib/kubelet/plugins/staging/pv-1"
+	targetPath := "/var/lib/kubelet/pods/pod-1/volumes/pv-1"
+
+	if err := node.Driver.mounter.Mount("/dev/vdb", stagingPath, "ext4"); err != nil {
+		t.Fatalf("failed to stage volume: %v", err)
+	}
+
+	_, err := node.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+		VolumeId:          "c56c7b6e-15c2-445e-9a5d-1063ab5828ec",
+		StagingTargetPath: stagingPath,
+		TargetPath:        targetPath,
+		VolumeCapability:  mountVolumeCapability(),
+	})
+
+	if err != nil {
+		t.Errorf("Expected no error, got error : %v", err)
+	}
+
+	mounted, _ := node.Driver.mounter.IsMounted(targetPath)
+	if !mounted {
+		t.Errorf("expected %s to be mounted", targetPath)
+	}
+}
+
+func TestNodePublishVolumeNotStaged(t *testing.T) {
+	node := NewFakeVultrNodeServer("node publish volume not staged")
+	targetPath := "/var/lib/kubelet/pods/pod-1/volumes/pv-1"
+
+	_, err := node.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+		VolumeId:          "c56c7b6e-15c2-445e-9a5d-1063ab5828ec",
+		StagingTargetPath: "/var/lib/kubelet/plugins/staging/pv-1",
+		TargetPath:        targetPath,
+		VolumeCapability:  mountVolumeCapability(),
+	})
+
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("expected %v got %v", codes.FailedPrecondition, err)
+	}
+
+	mounted, _ := node.Driver.mounter.IsMounted(targetPath)
+	if mounted {
+		t.Errorf("expected %s not to be mounted", targetPath)
+	}
+}
+
+func TestNodePublishVolumeEphemeral(t *testing.T) {
+	node := NewFakeVultrNodeServer("node publish volume ephemeral")
+
+	_, err := node.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+		VolumeId:         "csi-4d1b1d7c0e6b",
+		TargetPath:       "/var/lib/kubelet/pods/pod-1/volumes/scratch/mount",
+		VolumeCapability: mountVolumeCapability(),
+		VolumeContext:    map[string]string{ephemeralKey: "true"},
+	})
+
+	if status.Code(err) != codes.InvalidArgument || !strings.Contains(err.Error(), "ephemeral") {
+		t.Errorf("Expected code %v naming ephemeral volumes, got %v", codes.InvalidArgument, err)
+	}
+}
+
+func TestNodeExpandVolume(t *testing.T) {
+	node := NewFakeVultrNodeServer("node expand volume")
+	volumePath := "/var/lib/kubelet/pods/pod-1/volumes/pv-1"
+	mounter := node.Driver.mounter.(*fakeMounter)
+
+	if err := mounter.Mount("/dev/vdb", volumePath, "ext4"); err != nil {
+		t.Fatalf("failed to mount volume: %v", err)
+	}
+
+	// the device only reflects the new size on the third check
+	mounter.deviceSizes["/dev/vdb"] = []int64{10 * giB, 10 * giB, 20 * giB}
+
+	resp, err := node.NodeExpandVolume(context.Background(), &csi.NodeExpandVolumeRequest{
+		VolumeId:         "c56c7b6e-15c2-445e-9a5d-1063ab5828ec",
+		VolumePath:       volumePath,
+		CapacityRange:    &csi.CapacityRange{RequiredBytes: 20 * giB},
+		VolumeCapability: mountVolumeCapability(),
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got error : %v", err)
+	}
+
+	if resp.CapacityBytes != 20*giB {
+		t.Errorf("Expected capacity %d, got %d", 20*giB, resp.CapacityBytes)
+	}
+
+	if fs := mounter.resized[volumePath]; fs != "ext4" {
+		t.Errorf("Expected ext4 filesystem on %s to be resized, got %q", volumePath, fs)
+	}
+}
+
+func TestNodeExpandVolumeEncrypted(t *testing.T) {
+	node := NewFakeVultrNodeServer("node expand volume encrypted")
+	volumeID := "c56c7b6e-15c2-445e-9a5d-1063ab5828ec"
+	volumePath := "/var/lib/kubelet/pods/pod-1/volumes/pv-1"
+	device := getDeviceByPath(volumeID)
+	name := luksMapperPrefix + volumeID
+	mapper := filepath.Join(luksMapperPath, name)
+	mounter := node.Driver.mounter.(*fakeMounter)
+
+	mounter.luks[device] = "passphrase"
+	mounter.luksOpen[name] = device
+	if err := mounter.Mount(mapper, volumePath, "ext4"); err != nil {
+		t.Fatalf("failed to mount volume: %v", err)
+	}
+
+	// the mapper stays short of the disk by the LUKS header
+	mounter.deviceSizes[device] = []int64{10 * giB, 20 * giB}
+	mounter.deviceSizes[mapper] = []int64{10*giB - 16*miB}
+
+	resp, err := node.NodeExpandVolume(context.Background(), &csi.NodeExpandVolumeRequest{
+		VolumeId:         volumeID,
+		VolumePath:       volumePath,
+		CapacityRange:    &csi.CapacityRange{RequiredBytes: 20 * giB},
+		VolumeCapability: mountVolumeCapability(),
+		Secrets:          map[string]string{encryptionPassphraseKey: "passphrase"},
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got error : %v", err)
+	}
+
+	if resp.CapacityBytes != 20*giB {
+		t.Errorf("Expected capacity %d, got %d", 20*giB, resp.CapacityBytes)
+	}
+
+	if !mounter.luksResized[name] {
+		t.Errorf("Expected LUKS device %s to be resized", name)
+	}
+
+	if fs := mounter.resized[volumePath]; fs != "ext4" {
+		t.Errorf("Expected ext4 filesystem on %s to be resized, got %q", volumePath, fs)
+	}
+}
+
+func TestNodeExpandVolumeDeviceNotGrown(t *testing.T) {
+	node := NewFakeVultrNodeServer("node expand volume device not grown")
+	node.Driver.statusCheckRetries = 2
+	volumePath := "/var/lib/kubelet/pods/pod-1/volumes/pv-1"
+	mounter := node.Driver.mounter.(*fakeMounter)
+
+	if err := mounter.Mount("/dev/vdb", volumePath, "ext4"); err != nil {
+		t.Fatalf("failed to mount volume: %v", err)
+	}
+
+	_, err := node.NodeExpandVolume(context.Background(), &csi.NodeExpandVolumeRequest{
+		VolumeId:      "c56c7b6e-15c2-445e-9a5d-1063ab5828ec",
+		VolumePath:    volumePath,
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 20 * giB},
+	})
+
+	if status.Code(err) != codes.Internal {
+		t.Errorf("Expected code %v, got %v", codes.Internal, status.Code(err))
+	}
+
+	if _, ok := mounter.resized[volumePath]; ok {
+		t.Error("Expected filesystem not to be resized before the device grew")
+	}
+}
+
+func TestNodeExpandVolumeBlock(t *testing.T) {
+	node := NewFakeVultrNodeServer("node expand volume block")
+	volumePath := "/var/lib/kubelet/plugins/volumeDevices/publish/pv-1"
+	mounter := node.Driver.mounter.(*fakeMounter)
+
+	if err := mounter.Mount("/dev/vdb", volumePath, ""); err != nil {
+		t.Fatalf("failed to mount volume: %v", err)
+	}
+
+	_, err := node.NodeExpandVolume(context.Background(), &csi.NodeExpandVolumeRequest{
+		VolumeId:   "c56c7b6e-15c2-445e-9a5d-1063ab5828ec",
+		VolumePath: volumePath,
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Block{
+				Block: &csi.VolumeCapability_BlockVolume{},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got error : %v", err)
+	}
+
+	if _, ok := mounter.resized[volumePath]; ok {
+		t.Error("Expected block volume not to be resized")
+	}
+}
+
+func TestNodeExpandVolumeNotMounted(t *testing.T) {
+	node := NewFakeVultrNodeServer("node expand volume not mounted")
+
+	_, err := node.NodeExpandVolume(context.Background(), &csi.NodeExpandVolumeRequest{
+		VolumeId:   "c56c7b6e-15c2-445e-9a5d-1063ab5828ec",
+		VolumePath: "/var/lib/kubelet/pods/pod-1/volumes/pv-1",
+	})
+
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("Expected code %v, got %v", codes.NotFound, status.Code(err))
+	}
+}
+
+func TestNodeGetVolumeStats(t *testing.T) {
+	node := NewFakeVultrNodeServer("node get volume stats")
+	volumePath := "/var/lib/kubelet/pods/pod-1/volumes/pv-1"
+
+	if err := node.Driver.mounter.Mount("/dev/vdb", volumePath, "ext4"); err != nil {
+		t.Fatalf("failed to mount volume: %v", err)
+	}
+
+	resp, err := node.NodeGetVolumeStats(context.Background(), &csi.NodeGetVolumeStatsRequest{
+		VolumeId:   "c56c7b6e-15c2-445e-9a5d-1063ab5828ec",
+		VolumePath: volumePath,
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got error : %v", err)
+	}
+
+	if len(resp.Usage) != 2 {
+		t.Fatalf("Expected bytes and inodes usage, got %v", resp.Usage)
+	}
+
+	bytes, inodes := resp.Usage[0], resp.Usage[1]
+	if bytes.Unit != csi.VolumeUsage_BYTES || bytes.Total != 10*giB || bytes.Used != 7*giB || bytes.Available != 3*giB {
+		t.Errorf("Unexpected bytes usage: %v", bytes)
+	}
+
+	if inodes.Unit != csi.VolumeUsage_INODES || inodes.Total != 10000 || inodes.Used != 7000 || inodes.Available != 3000 {
+		t.Errorf("Unexpected inodes usage: %v", inodes)
+	}
+}
+
+func TestNodeGetVolumeStatsErrors(t *testing.T) {
+	tests := []struct {
+		name       string
+		volumePath string
+		code       codes.Code
+	}{
+		{"missing volume path", "", codes.InvalidArgument},
+		{"nonexistent volume path", "/var/lib/kubelet/pods/pod-1/volumes/missing", codes.NotFound},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			node := NewFakeVultrNodeServer(test.name)
+
+			_, err := node.NodeGetVolumeStats(context.Background(), &csi.NodeGetVolumeStatsRequest{
+				VolumeId:   "c56c7b6e-15c2-445e-9a5d-1063ab5828ec",
+				VolumePath: test.volumePath,
+			})
+
+			if status.Code(err) != test.code {
+				t.Errorf("Expected code %v, got %v", test.code, status.Code(err))
+			}
+		})
+	}
+}
+
+func TestNodeStageVolumeFsType(t *testing.T) {
+	tests := []struct {
+		name          string
+		volumeContext map[string]string
+		mountFsType   string
+		expected      string
+		code          codes.Code
+	}{
+		{name: "default", expected: fsTypeExt4},
+		{name: "capability fs type", mountFsType: fsTypeXFS, expected: fsTypeXFS},
+		{name: "volume context fs type", volumeContext: map[string]string{fsTypeKey: fsTypeXFS}, mountFsType: fsTypeExt4, expected: fsTypeXFS},
+		{name: "unsupported fs type", volumeContext: map[string]string{fsTypeKey: "btrfs"}, code: codes.InvalidArgument},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			node := NewFakeVultrNodeServer(test.name)
+			capability := mountVolumeCapability()
+			capability.GetMount().FsType = test.mountFsType
+
+			_, err := node.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+				VolumeId:          "c56c7b6e-15c2-445e-9a5d-1063ab5828ec",
+				PublishContext:    map[string]string{node.Driver.mountID: "c56c7b6e-15c2-445e-9a5d-1063ab5828ec"},
+				StagingTargetPath: "/var/lib/kubelet/plugins/staging/pv-1",
+				VolumeCapability:  capability,
+				VolumeContext:     test.volumeContext,
+			})
+
+			if status.Code(err) != test.code {
+				t.Fatalf("Expected code %v, got %v", test.code, err)
+			}
+
+			if test.code != codes.OK {
+				return
+			}
+
+			source := getDeviceByPath("c56c7b6e-15c2-445e-9a5d-1063ab5828ec")
+			if fs := node.Driver.mounter.(*fakeMounter).formatted[source]; fs != test.expected {
+				t.Errorf("Expected %s to be formatted as %q, got %q", source, test.expected, fs)
+			}
+		})
+	}
+}
+
+func TestNodeStageVolumeFormatOnce(t *testing.T) {
+	volumeID := "c56c7b6e-15c2-445e-9a5d-1063ab5828ec"
+	source := getDeviceByPath(volumeID)
+
+	tests := []struct {
+		name      string
+		formatted map[string]string
+		formats   int
+		expected  string
+	}{
+		{name: "blank device", formats: 1, expected: fsTypeExt4},
+		{name: "existing filesystem", formatted: map[string]string{source: fsTypeXFS}, expected: fsTypeXFS},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			node := NewFakeVultrNodeServer(test.name)
+			mounter := node.Driver.mounter.(*fakeMounter)
+			for device, fs := range test.formatted {
+				mounter.formatted[device] = fs
+			}
+
+			req := &csi.NodeStageVolumeRequest{
+				VolumeId:          volumeID,
+				PublishContext:    map[string]string{node.Driver.mountID: volumeID},
+				StagingTargetPath: "/var/lib/kubelet/plugins/staging/pv-1",
+				VolumeCapability:  mountVolumeCapability(),
+			}
+
+			// restaging an already staged volume must not format it again
+			for i := 0; i < 2; i++ {
+				if _, err := node.NodeStageVolume(context.Background(), req); err != nil {
+					t.Fatalf("Expected no error, got error : %v", err)
+				}
+			}
+
+			if mounter.formats != test.formats {
+				t.Errorf("Expected %d formats, got %d", test.formats, mounter.formats)
+			}
+
+			if fs := mounter.formatted[source]; fs != test.expected {
+				t.Errorf("Expected %s to hold %q, got %q", source, test.expected, fs)
+			}
+
+			if mounter.mounted[req.StagingTargetPath] != source {
+				t.Errorf("Expected %s to be mounted at %s, got %v", source, req.StagingTargetPath, mounter.mounted)
+			}
+		})
+	}
+}
+
+func TestNodeStageVolumeWaitForDevice(t *testing.T) {
+	volumeID := "c56c7b6e-15c2-445e-9a5d-1063ab5828ec"
+	source := getDeviceByPath(volumeID)
+
+	tests := []struct {
+		name    string
+		missing int
+		code    codes.Code
+	}{
+		{name: "device present"},
+		{name: "device appears", missing: 2},
+		{name: "device never appears", missing: 100, code: codes.Internal},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			node := NewFakeVultrNodeServer(test.name)
+			mounter := node.Driver.mounter.(*fakeMounter)
+			mounter.missingDevices[source] = test.missing
+
+			_, err := node.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+				VolumeId:          volumeID,
+				PublishContext:    map[string]string{node.Driver.mountID: volumeID},
+				StagingTargetPath: "/var/lib/kubelet/plugins/staging/pv-1",
+				VolumeCapability:  mountVolumeCapability(),
+			})
+
+			if status.Code(err) != test.code {
+				t.Fatalf("Expected code %v, got %v", test.code, err)
+			}
+
+			if err != nil && !strings.Contains(err.Error(), volumeID) {
+				t.Errorf("Expected the error to name disk %s, got %v", volumeID, err)
+			}
+
+			if mounted := mounter.mounted["/var/lib/kubelet/plugins/staging/pv-1"] == source; mounted != (err == nil) {
+				t.Errorf("Expected mounted %v, got mounts %v", err == nil, mounter.mounted)
+			}
+		})
+	}
+}
+
+func TestNodeStageVolumeMissingPublishContext(t *testing.T) {
+	node := NewFakeVultrNodeServer("node stage volume missing publish context")
+
+	_, err := node.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+		VolumeId:          "c56c7b6e-15c2-445e-9a5d-1063ab5828ec",
+		StagingTargetPath: "/var/lib/kubelet/plugins/staging/pv-1",
+		VolumeCapability:  mountVolumeCapability(),
+	})
+
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expected code %v, got %v", codes.InvalidArgument, err)
+	}
+}
+
+func TestNodeUnpublishVolume(t *testing.T) {
+	target := "/var/lib/kubelet/pods/pod-1/volumes/pv-1/mount"
+
+	tests := []struct {
+		name    string
+		mounted bool
+		busy    bool
+		code    codes.Code
+		removed bool
+	}{
+		{name: "mounted", mounted: true, removed: true},
+		{name: "already unmounted", removed: true},
+		{name: "busy", mounted: true, busy: true, code: codes.Internal},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			node := NewFakeVultrNodeServer(test.name)
+			mounter := node.Driver.mounter.(*fakeMounter)
+			if test.mounted {
+				mounter.mounted[target] = "/var/lib/kubelet/plugins/staging/pv-1"
+			}
+			mounter.busy[target] = test.busy
+
+			_, err := node.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{
+				VolumeId:   "c56c7b6e-15c2-445e-9a5d-1063ab5828ec",
+				TargetPath: target,
+			})
+
+			if status.Code(err) != test.code {
+				t.Fatalf("Expected code %v, got %v", test.code, err)
+			}
+
+			if mounter.removed[target] != test.removed {
+				t.Errorf("Expected target removed %v, got %v", test.removed, mounter.removed[target])
+			}
+		})
+	}
+}
+
+func TestNodeUnstageVolume(t *testing.T) {
+	target := "/var/lib/kubelet/plugins/staging/pv-1"
+
+	tests := []struct {
+		name    string
+		mounted bool
+		busy    bool
+		code    codes.Code
+	}{
+		{name: "mounted", mounted: true},
+		{name: "already unmounted"},
+		{name: "busy", mounted: true, busy: true, code: codes.Internal},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			node := NewFakeVultrNodeServer(test.name)
+			mounter := node.Driver.mounter.(*fakeMounter)
+			if test.mounted {
+				mounter.mounted[target] = getDeviceByPath("c56c7b6e-15c2-445e-9a5d-1063ab5828ec")
+			}
+			mounter.busy[target] = test.busy
+
+			_, err := node.NodeUnstageVolume(context.Background(), &csi.NodeUnstageVolumeRequest{
+				VolumeId:          "c56c7b6e-15c2-445e-9a5d-1063ab5828ec",
+				StagingTargetPath: target,
+			})
+
+			if status.Code(err) != test.code {
+				t.Fatalf("Expected code %v, got %v", test.code, err)
+			}
+
+			if _, mounted := mounter.mounted[target]; mounted != test.busy {
+				t.Errorf("Expected mounted %v, got %v", test.busy, mounted)
+			}
+		})
+	}
+}
+
+func TestValidateMountFlags(t *testing.T) {
+	tests := []struct {
+		name  string
+		flags []string
+		code  codes.Code
+	}{
+		{name: "no flags"},
+		{name: "compatible flags", flags: []string{"noatime", "discard", "errors=remount-ro"}},
+		{name: "conflicting flags", flags: []string{"ro", "noatime", "rw"}, code: codes.InvalidArgument},
+		{name: "empty flag", flags: []string{""}, code: codes.InvalidArgument},
+		{name: "embedded separator", flags: []string{"noatime,exec"}, code: codes.InvalidArgument},
+		{name: "several conflicting pairs", flags: []string{"nodiscard", "discard", "rw", "ro"}, code: codes.InvalidArgument},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := validateMountFlags(test.flags)
+			if status.Code(err) != test.code {
+				t.Errorf("Expected code %v, got %v", test.code, err)
+			}
+		})
+	}
+}
+
+func TestValidateMountFlagsOrder(t *testing.T) {
+	// with several conflicting pairs the first pair in conflictingMountFlags is reported
+	for i := 0; i < 10; i++ {
+		err := validateMountFlags([]string{"nosuid", "suid", "noatime", "atime"})
+		if !strings.Contains(status.Convert(err).Message(), `"atime" conflicts with "noatime"`) {
+			t.Fatalf("Expected the atime conflict to be reported, got %v", err)
+		}
+	}
+}
+
+func TestNodePublishVolumeConflictingMountFlags(t *testing.T) {
+	node := NewFakeVultrNodeServer("node publish volume conflicting mount flags")
+	stagingPath := "/var/lib/kubelet/plugins/staging/pv-1"
+	targetPath := "/var/lib/kubelet/pods/pod-1/volumes/pv-1"
+
+	if err := node.Driver.mounter.Mount("/dev/vdb", stagingPath, "ext4"); err != nil {
+		t.Fatalf("failed to stage volume: %v", err)
+	}
+
+	capability := mountVolumeCapability()
+	capability.GetMount().MountFlags = []string{"noatime", "atime"}
+
+	_, err := node.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+		VolumeId:          "c56c7b6e-15c2-445e-9a5d-1063ab5828ec",
+		StagingTargetPath: stagingPath,
+		TargetPath:        targetPath,
+		VolumeCapability:  capability,
+	})
+
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expected code %v, got %v", codes.InvalidArgument, err)
+	}
+
+	if mounted, _ := node.Driver.mounter.IsMounted(targetPath); mounted {
+		t.Error("Expected target path not to be mounted")
+	}
+}
+
+func TestNodePublishVolumeReadonlyOverridesRW(t *testing.T) {
+	node := NewFakeVultrNodeServer("node publish volume readonly overrides rw")
+	mounter := node.Driver.mounter.(*fakeMounter)
+	stagingPath := "/var/lib/kubelet/plugins/staging/pv-1"
+	targetPath := "/var/lib/kubelet/pods/pod-1/volumes/pv-1"
+
+	if err := node.Driver.mounter.Mount("/dev/vdb", stagingPath, "ext4"); err != nil {
+		t.Fatalf("failed to stage volume: %v", err)
+	}
+
+	capability := mountVolumeCapability()
+	capability.GetMount().MountFlags = []string{"rw", "noatime"}
+
+	_, err := node.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+		VolumeId:          "c56c7b6e-15c2-445e-9a5d-1063ab5828ec",
+		StagingTargetPath: stagingPath,
+		TargetPath:        targetPath,
+		Readonly:          true,
+		VolumeCapability:  capability,
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got error : %v", err)
+	}
+
+	expected := []string{"bind", "noatime", "ro"}
+	if !reflect.DeepEqual(mounter.options[targetPath], expected) {
+		t.Errorf("Expected mount options %v, got %v", expected, mounter.options[targetPath])
+	}
+}
+
+func TestNodeGetInfoMaxVolumes(t *testing.T) {
+	node := NewFakeVultrNodeServer("node get info max volumes")
+	node.Driver.maxVolumesPerNode = 8
+
+	res, err := node.NodeGetInfo(context.Background(), &csi.NodeGetInfoRequest{})
+	if err != nil {
+		t.Fatalf("Expected no error, got error : %v", err)
+	}
+
+	if res.MaxVolumesPerNode != 8 {
+		t.Errorf("Expected max volumes per node %d, got %d", 8, res.MaxVolumesPerNode)
+	}
+}
+
+func TestNodeBlockVolume(t *testing.T) {
+	node := NewFakeVultrNodeServer("node block volume")
+	mounter := node.Driver.mounter.(*fakeMounter)
+	ctx := context.Background()
+
+	volumeID := "c56c7b6e-15c2-445e-9a5d-1063ab5828ec"
+	stagingPath := "/var/lib/kubelet/plugins/kubernetes.io/csi/volumeDevices/staging/pv-1"
+	targetPath := "/var/lib/kubelet/plugins/kubernetes.io/csi/volumeDevices/publish/pv-1/pod-1"
+	publishContext := map[string]string{node.Driver.mountID: volumeID}
+	capability := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Block{
+			Block: &csi.VolumeCapability_BlockVolume{},
+		},
+		AccessMode: &csi.VolumeCapability_AccessMode{
+			Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+		},
+	}
+
+	_, err := node.NodeStageVolume(ctx, &csi.NodeStageVolumeRequest{
+		VolumeId:          volumeID,
+		PublishContext:    publishContext,
+		StagingTargetPath: stagingPath,
+		VolumeCapability:  capability,
+	})
+	if err != nil {
+		t.Fatalf("NodeStageVolume: expected no error, got error : %v", err)
+	}
+
+	if len(mounter.formatted) != 0 {
+		t.Errorf("Expected block volume not to be formatted, got %v", mounter.formatted)
+	}
+
+	_, err = node.NodePublishVolume(ctx, &csi.NodePublishVolumeRequest{
+		VolumeId:          volumeID,
+		PublishContext:    publishContext,
+		StagingTargetPath: stagingPath,
+		TargetPath:        targetPath,
+		VolumeCapability:  capability,
+	})
+	if err != nil {
+		t.Fatalf("NodePublishVolume: expected no error, got error : %v", err)
+	}
+
+	if source := mounter.mounted[targetPath]; source != getDeviceByPath(volumeID) || !mounter.blocks[targetPath] {
+		t.Fatalf("Expected device %s to be bind mounted on %s, got %q", getDeviceByPath(volumeID), targetPath, source)
+	}
+
+	stats, err := node.NodeGetVolumeStats(ctx, &csi.NodeGetVolumeStatsRequest{
+		VolumeId:   volumeID,
+		VolumePath: targetPath,
+	})
+	if err != nil {
+		t.Fatalf("NodeGetVolumeStats: expected no error, got error : %v", err)
+	}
+
+	if len(stats.Usage) != 1 || stats.Usage[0].Total != 10*giB {
+		t.Errorf("Expected only the total size of the block volume, got %v", stats.Usage)
+	}
+
+	_, err = node.NodeExpandVolume(ctx, &csi.NodeExpandVolumeRequest{
+		VolumeId:         volumeID,
+		VolumePath:       targetPath,
+		CapacityRange:    &csi.CapacityRange{RequiredBytes: 20 * giB},
+		VolumeCapability: capability,
+	})
+	if err != nil {
+		t.Fatalf("NodeExpandVolume: expected no error, got error : %v", err)
+	}
+
+	if len(mounter.resized) != 0 {
+		t.Errorf("Expected block volume not to be resized, got %v", mounter.resized)
+	}
+
+	_, err = node.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{
+		VolumeId:   volumeID,
+		TargetPath: targetPath,
+	})
+	if err != nil {
+		t.Fatalf("NodeUnpublishVolume: expected no error, got error : %v", err)
+	}
+
+	_, err = node.NodeUnstageVolume(ctx, &csi.NodeUnstageVolumeRequest{
+		VolumeId:          volumeID,
+		StagingTargetPath: stagingPath,
+	})
+	if err != nil {
+		t.Fatalf("NodeUnstageVolume: expected no error, got error : %v", err)
+	}
+
+	if len(mounter.mounted) != 0 {
+		t.Errorf("Expected nothing to be left mounted, got %v", mounter.mounted)
+	}
+}
+
+func TestNodeStageVolumeEncrypted(t *testing.T) {
+	node := NewFakeVultrNodeServer("node stage volume encrypted")
+	mounter := node.Driver.mounter.(*fakeMounter)
+	ctx := context.Background()
+
+	volumeID := "c56c7b6e-15c2-445e-9a5d-1063ab5828ec"
+	stagingPath := "/var/lib/kubelet/plugins/staging/pv-1"
+	device := getDeviceByPath(volumeID)
+	mapper := "/dev/mapper/" + luksMapperPrefix + volumeID
+
+	stage := func(passphrase string) error {
+		_, err := node.NodeStageVolume(ctx, &csi.NodeStageVolumeRequest{
+			VolumeId:          volumeID,
+			PublishContext:    map[string]string{node.Driver.mountID: volumeID},
+			StagingTargetPath: stagingPath,
+			VolumeCapability:  mountVolumeCapability(),
+			VolumeContext:     map[string]string{encryptedKey: "true"},
+			Secrets:           map[string]string{encryptionPassphraseKey: passphrase},
+		})
+		return err
+	}
+
+	unstage := func() {
+		_, err := node.NodeUnstageVolume(ctx, &csi.NodeUnstageVolumeRequest{
+			VolumeId:          volumeID,
+			StagingTargetPath: stagingPath,
+		})
+		if err != nil {
+			t.Fatalf("NodeUnstageVolume: expected no error, got error : %v", err)
+		}
+	}
+
+	if err := stage(""); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expected code %v without a passphrase, got %v", codes.InvalidArgument, err)
+	}
+
+	if err := stage("secret"); err != nil {
+		t.Fatalf("NodeStageVolume: expected no error, got error : %v", err)
+	}
+
+	if mounter.luks[device] != "secret" {
+		t.Errorf("Expected %s to be encrypted", device)
+	}
+
+	if source := mounter.mounted[stagingPath]; source != mapper {
+		t.Errorf("Expected %s to be mounted on %s, got %q", mapper, stagingPath, source)
+	}
+
+	if _, ok := mounter.formatted[device]; ok {
+		t.Errorf("Expected the filesystem to be created on %s, not on %s", mapper, device)
+	}
+
+	unstage()
+	if open, _ := mounter.IsLuksOpen(luksMapperPrefix + volumeID); open {
+		t.Error("Expected the LUKS device to be closed on unstage")
+	}
+
+	if err := stage("wrong"); status.Code(err) != codes.Internal {
+		t.Errorf("Expected code %v with the wrong passphrase, got %v", codes.Internal, err)
+	}
+
+	if err := stage("secret"); err != nil {
+		t.Fatalf("NodeStageVolume: expected no error restaging, got error : %v", err)
+	}
+
+	if source := mounter.mounted[stagingPath]; source != mapper {
+		t.Errorf("Expected %s to be mounted on %s again, got %q", mapper, stagingPath, source)
+	}
+}
+
+func TestNodeStageVolumeEncryptedExistingFilesystem(t *testing.T) {
+	node := NewFakeVultrNodeServer("node stage volume encrypted existing filesystem")
+	volumeID := "c56c7b6e-15c2-445e-9a5d-1063ab5828ec"
+
+	if err := node.Driver.mounter.Format(getDeviceByPath(volumeID), "ext4"); err != nil {
+		t.Fatalf("failed to format device: %v", err)
+	}
+
+	_, err := node.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+		VolumeId:          volumeID,
+		PublishContext:    map[string]string{node.Driver.mountID: volumeID},
+		StagingTargetPath: "/var/lib/kubelet/plugins/staging/pv-1",
+		VolumeCapability:  mountVolumeCapability(),
+		VolumeContext:     map[string]string{encryptedKey: "true"},
+		Secrets:           map[string]string{encryptionPassphraseKey: "secret"},
+	})
+
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("Expected code %v, got %v", codes.FailedPrecondition, err)
+	}
+}
@@ -0,0 +1,151 @@
+/*
+Copyright 2020 Vultr Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/vultr/govultr/v2"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	rateLimitRetries     = 5
+	rateLimitInterval    = 2 * time.Second
+	rateLimitMaxInterval = 30 * time.Second
+)
+
+var _ govultr.BlockStorageService = &rateLimitedBlockStorage{}
+
+// rateLimitedBlockStorage retries block storage calls that were rejected by
+// the API rate limit. The govultr HTTP client already retries a 429 a few
+// times, honouring Retry-After, this backs off for longer once it gives up.
+// When the retries are exhausted the call fails with ResourceExhausted so the
+// CO backs off as well.
+type rateLimitedBlockStorage struct {
+	govultr.BlockStorageService
+
+	retries     int
+	interval    time.Duration
+	maxInterval time.Duration
+}
+
+func newRateLimitedBlockStorage(bs govultr.BlockStorageService) *rateLimitedBlockStorage {
+	return &rateLimitedBlockStorage{
+		BlockStorageService: bs,
+		retries:             rateLimitRetries,
+		interval:            rateLimitInterval,
+		maxInterval:         rateLimitMaxInterval,
+	}
+}
+
+// retry calls fn until it succeeds, fails for a reason other than the rate
+// limit or the retries are exhausted
+func (r *rateLimitedBlockStorage) retry(ctx context.Context, fn func() error) error {
+	interval := r.interval
+	for i := 0; ; i++ {
+		err := fn()
+		if err == nil || !isRateLimited(err) {
+			return err
+		}
+
+		if i >= r.retries {
+			return status.Errorf(codes.ResourceExhausted, "Vultr API rate limit exceeded after %d retries: %v", r.retries, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return status.FromContextError(ctx.Err()).Err()
+		case <-time.After(interval):
+		}
+
+		interval *= 2
+		if interval > r.maxInterval {
+			interval = r.maxInterval
+		}
+	}
+}
+
+func (r *rateLimitedBlockStorage) Create(ctx context.Context, blockReq *govultr.BlockStorageCreate) (*govultr.BlockStorage, error) {
+	var bs *govultr.BlockStorage
+	err := r.retry(ctx, func() (err error) {
+		bs, err = r.BlockStorageService.Create(ctx, blockReq)
+		return err
+	})
+	return bs, err
+}
+
+func (r *rateLimitedBlockStorage) Get(ctx context.Context, blockID string) (*govultr.BlockStorage, error) {
+	var bs *govultr.BlockStorage
+	err := r.retry(ctx, func() (err error) {
+		bs, err = r.BlockStorageService.Get(ctx, blockID)
+		return err
+	})
+	return bs, err
+}
+
+func (r *rateLimitedBlockStorage) Update(ctx context.Context, blockID string, blockReq *govultr.BlockStorageUpdate) error {
+	return r.retry(ctx, func() error {
+		return r.BlockStorageService.Update(ctx, blockID, blockReq)
+	})
+}
+
+func (r *rateLimitedBlockStorage) Delete(ctx context.Context, blockID string) error {
+	return r.retry(ctx, func() error {
+		return r.BlockStorageService.Delete(ctx, blockID)
+	})
+}
+
+func (r *rateLimitedBlockStorage) List(ctx context.Context, options *govultr.ListOptions) ([]govultr.BlockStorage, *govultr.Meta, error) {
+	var list []govultr.BlockStorage
+	var meta *govultr.Meta
+	err := r.retry(ctx, func() (err error) {
+		list, meta, err = r.BlockStorageService.List(ctx, options)
+		return err
+	})
+	return list, meta, err
+}
+
+func (r *rateLimitedBlockStorage) Attach(ctx context.Context, blockID string, attach *govultr.BlockStorageAttach) error {
+	return r.retry(ctx, func() error {
+		return r.BlockStorageService.Attach(ctx, blockID, attach)
+	})
+}
+
+func (r *rateLimitedBlockStorage) Detach(ctx context.Context, blockID string, detach *govultr.BlockStorageDetach) error {
+	return r.retry(ctx, func() error {
+		return r.BlockStorageService.Detach(ctx, blockID, detach)
+	})
+}
+
+// isRateLimited reports whether the API rejected the request with a 429, the
+// body is quoted when the HTTP client gave up retrying
+func isRateLimited(err error) bool {
+	msg := err.Error()
+	return strings.Contains(msg, `"status":429`) ||
+		strings.Contains(msg, `\"status\":429`) ||
+		strings.Contains(strings.ToLower(msg), "rate limit")
+}
+
+// apiErrorf converts an API error into a status error with code, an exhausted
+// rate limit keeps its ResourceExhausted status so the CO backs off
+func apiErrorf(err error, code codes.Code, format string, a ...interface{}) error {
+	if status.Code(err) == codes.ResourceExhausted {
+		return err
+	}
+	return status.Errorf(code, format, a...)
+}
@@ -0,0 +1,105 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/vultr/govultr/v2"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var errRateLimited = errors.New(`gave up after 4 attempts, last error: "{\"error\":\"Rate limit exceeded\",\"status\":429}"`)
+
+// rateLimitedBS rejects the first failures calls with a 429
+type rateLimitedBS struct {
+	fakeBS
+	failures int
+	calls    int
+}
+
+func (r *rateLimitedBS) Get(ctx context.Context, volID string) (*govultr.BlockStorage, error) {
+	r.calls++
+	if r.calls <= r.failures {
+		return nil, errRateLimited
+	}
+	return r.fakeBS.Get(ctx, volID)
+}
+
+func (r *rateLimitedBS) List(ctx context.Context, options *govultr.ListOptions) ([]govultr.BlockStorage, *govultr.Meta, error) {
+	r.calls++
+	if r.calls <= r.failures {
+		return nil, nil, errRateLimited
+	}
+	return r.fakeBS.List(ctx, options)
+}
+
+func newTestRateLimitedBlockStorage(bs govultr.BlockStorageService) *rateLimitedBlockStorage {
+	r := newRateLimitedBlockStorage(bs)
+	r.interval = time.Millisecond
+	r.maxInterval = 10 * time.Millisecond
+	return r
+}
+
+func TestRateLimitedBlockStorage(t *testing.T) {
+	tests := []struct {
+		name     string
+		failures int
+		code     codes.Code
+		calls    int
+	}{
+		{name: "no rate limit", calls: 1},
+		{name: "recovers", failures: 3, calls: 4},
+		{name: "exhausted", failures: 100, code: codes.ResourceExhausted, calls: rateLimitRetries + 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			bs := &rateLimitedBS{failures: test.failures}
+
+			_, err := newTestRateLimitedBlockStorage(bs).Get(context.Background(), "c56c7b6e-15c2-445e-9a5d-1063ab5828ec")
+			if status.Code(err) != test.code {
+				t.Errorf("Expected code %v, got %v", test.code, err)
+			}
+
+			if bs.calls != test.calls {
+				t.Errorf("Expected %d calls, got %d", test.calls, bs.calls)
+			}
+		})
+	}
+}
+
+func TestRateLimitedBlockStorageOtherError(t *testing.T) {
+	bs := &deleteErrorBS{err: errors.New(`{"error":"invalid block storage","status":400}`)}
+
+	err := newTestRateLimitedBlockStorage(bs).Delete(context.Background(), "c56c7b6e-15c2-445e-9a5d-1063ab5828ec")
+	if err != bs.err {
+		t.Errorf("Expected the API error to be returned unchanged, got %v", err)
+	}
+}
+
+func TestCreateVolumeRateLimited(t *testing.T) {
+	controller := NewFakeVultrControllerServer("create volume rate limited")
+	controller.Driver.client.BlockStorage = newTestRateLimitedBlockStorage(&rateLimitedBS{failures: 100})
+
+	_, err := controller.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name: "volume-test-name",
+		VolumeCapabilities: []*csi.VolumeCapability{
+			{
+				AccessType: &csi.VolumeCapability_Mount{
+					Mount: &csi.VolumeCapability_MountVolume{},
+				},
+				AccessMode: &csi.VolumeCapability_AccessMode{
+					Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+				},
+			},
+		},
+	})
+
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("Expected code %v, got %v", codes.ResourceExhausted, err)
+	}
+}
@@ -15,8 +15,6 @@ limitations under the License.
 package driver
 
 import (
-	"context"
-	"fmt"
 	"net"
 	"net/url"
 	"os"
@@ -39,15 +37,16 @@ type NonBlockingGRPCServer interface {
 	ForceStop()
 }
 
-// NewNonBlockingGRPCServer provides the non-blocking GRPC server
-func NewNonBlockingGRPCServer() NonBlockingGRPCServer {
-	return &nonBlockingGRPCServer{}
+// NewNonBlockingGRPCServer provides the non-blocking GRPC server, interceptors run in the order given
+func NewNonBlockingGRPCServer(interceptors ...grpc.UnaryServerInterceptor) NonBlockingGRPCServer {
+	return &nonBlockingGRPCServer{interceptors: interceptors}
 }
 
 // NonBlocking server
 type nonBlockingGRPCServer struct {
-	wg     sync.WaitGroup
-	server *grpc.Server
+	wg           sync.WaitGroup
+	server       *grpc.Server
+	interceptors []grpc.UnaryServerInterceptor
 }
 
 func (n *nonBlockingGRPCServer) Start(endpoint string, ids csi.IdentityServer, cs csi.ControllerServer, ns csi.NodeServer) {
@@ -69,7 +68,7 @@ func (n *nonBlockingGRPCServer) ForceStop() {
 
 func (n *nonBlockingGRPCServer) serve(endpoint string, ids csi.IdentityServer, cs csi.ControllerServer, ns csi.NodeServer) {
 	opts := []grpc.ServerOption{
-		grpc.UnaryInterceptor(GRPCLogger),
+		grpc.ChainUnaryInterceptor(n.interceptors...),
 	}
 
 	serveURL, err := url.Parse(endpoint)
@@ -119,19 +118,3 @@ func (n *nonBlockingGRPCServer) serve(endpoint string, ids csi.IdentityServer, c
 
 	n.wg.Done()
 }
-
-// GRPCLogger provides better error handling for gRPC calls
-func GRPCLogger(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
-	logger := log.WithFields(log.Fields{
-		"GRPC.call":    info.FullMethod,
-		"GRPC.request": fmt.Sprintf("%+v", req),
-	})
-
-	resp, err := handler(ctx, req)
-	if err != nil {
-		logger.Errorf("GRPC error: %v", err)
-	} else {
-		logger.Infof("GRPC response: %+v", resp)
-	}
-	return resp, err
-}
@@ -0,0 +1,266 @@
+package driver
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/vultr/govultr/v2"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+// serverBS keeps track of attachments so publish and unpublish see each other
+type serverBS struct {
+	storingBS
+	attached map[string]string
+}
+
+func (f *serverBS) Get(ctx context.Context, blockID string) (*govultr.BlockStorage, error) {
+	bs := newFakeBS()
+	bs.ID = blockID
+	bs.AttachedToInstance = f.attached[blockID]
+	return bs, nil
+}
+
+func (f *serverBS) Attach(ctx context.Context, blockID string, attach *govultr.BlockStorageAttach) error {
+	f.attached[blockID] = attach.InstanceID
+	return nil
+}
+
+func (f *serverBS) Detach(ctx context.Context, blockID string, detach *govultr.BlockStorageDetach) error {
+	delete(f.attached, blockID)
+	return nil
+}
+
+// newServerConn serves a driver backed by the fake client over a unix socket
+// and returns a connection to it, the server is stopped when the test ends
+func newServerConn(t *testing.T) *grpc.ClientConn {
+	dir, err := os.MkdirTemp("", "csi-server")
+	if err != nil {
+		t.Fatalf("cannot create socket dir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	d := NewFakeVultrControllerServer("grpc smoke").Driver
+	d.name = DefaultDriverName
+	d.version = "dev"
+	d.nodeID = "245bb2fe-b55c-44a0-9a1e-ab80e4b5f088"
+	d.mounter = NewFakeMounter(d.log)
+	d.client.BlockStorage = &serverBS{attached: map[string]string{}}
+
+	endpoint := "unix://" + filepath.Join(dir, "csi.sock")
+	server := NewNonBlockingGRPCServer(d.logInterceptor, d.history.Interceptor)
+	server.Start(endpoint, NewVultrIdentityServer(d), NewVultrControllerServer(d), NewVultrNodeDriver(d))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn, err := grpc.DialContext(ctx, endpoint, grpc.WithTransportCredentials(insecure.NewCredentials()), grpc.WithBlock())
+	if err != nil {
+		t.Fatalf("cannot connect to %s: %v", endpoint, err)
+	}
+
+	t.Cleanup(func() {
+		conn.Close()
+		server.ForceStop()
+	})
+
+	return conn
+}
+
+// TestGRPCSmoke calls the driver through the generated CSI clients for a
+// handful of spec behaviors that regress easily. It is a smoke test, not a
+// replacement for the csi-sanity suite from kubernetes-csi/csi-test.
+func TestGRPCSmoke(t *testing.T) {
+	conn := newServerConn(t)
+	identity := csi.NewIdentityClient(conn)
+	controller := csi.NewControllerClient(conn)
+	node := csi.NewNodeClient(conn)
+	ctx := context.Background()
+
+	capabilities := []*csi.VolumeCapability{
+		{
+			AccessType: &csi.VolumeCapability_Mount{
+				Mount: &csi.VolumeCapability_MountVolume{},
+			},
+			AccessMode: &csi.VolumeCapability_AccessMode{
+				Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+			},
+		},
+	}
+
+	t.Run("plugin info", func(t *testing.T) {
+		res, err := identity.GetPluginInfo(ctx, &csi.GetPluginInfoRequest{})
+		if err != nil {
+			t.Fatalf("Expected no error, got error : %v", err)
+		}
+
+		if res.Name == "" || res.VendorVersion == "" {
+			t.Errorf("expected a name and version, got %+v", res)
+		}
+	})
+
+	t.Run("probe", func(t *testing.T) {
+		res, err := identity.Probe(ctx, &csi.ProbeRequest{})
+		if err != nil {
+			t.Fatalf("Expected no error, got error : %v", err)
+		}
+
+		if !res.GetReady().GetValue() {
+			t.Errorf("expected the driver to be ready, got %+v", res)
+		}
+	})
+
+	t.Run("create volume idempotency", func(t *testing.T) {
+		req := &csi.CreateVolumeRequest{Name: "sanity-idempotent", VolumeCapabilities: capabilities}
+
+		first, err := controller.CreateVolume(ctx, req)
+		if err != nil {
+			t.Fatalf("Expected no error, got error : %v", err)
+		}
+
+		second, err := controller.CreateVolume(ctx, req)
+		if err != nil {
+			t.Fatalf("Expected no error, got error : %v", err)
+		}
+
+		if first.Volume.VolumeId != second.Volume.VolumeId || first.Volume.CapacityBytes != second.Volume.CapacityBytes {
+			t.Errorf("expected the same volume for the same request, got %+v and %+v", first.Volume, second.Volume)
+		}
+	})
+
+	t.Run("create volume without name", func(t *testing.T) {
+		_, err := controller.CreateVolume(ctx, &csi.CreateVolumeRequest{VolumeCapabilities: capabilities})
+		if status.Code(err) != codes.InvalidArgument {
+			t.Errorf("expected %v got %v", codes.InvalidArgument, err)
+		}
+	})
+
+	t.Run("create volume without capabilities", func(t *testing.T) {
+		_, err := controller.CreateVolume(ctx, &csi.CreateVolumeRequest{Name: "sanity-no-capabilities"})
+		if status.Code(err) != codes.InvalidArgument {
+			t.Errorf("expected %v got %v", codes.InvalidArgument, err)
+		}
+	})
+
+	t.Run("delete volume without id", func(t *testing.T) {
+		_, err := controller.DeleteVolume(ctx, &csi.DeleteVolumeRequest{})
+		if status.Code(err) != codes.InvalidArgument {
+			t.Errorf("expected %v got %v", codes.InvalidArgument, err)
+		}
+	})
+
+	t.Run("delete unknown volume", func(t *testing.T) {
+		_, err := controller.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: "9d2d5a4c-0f5e-4b3c-8d1e-5a0f6c7b8e9d"})
+		if err != nil {
+			t.Errorf("Expected no error, got error : %v", err)
+		}
+	})
+
+	t.Run("publish and unpublish", func(t *testing.T) {
+		volumeID := "0b1c2d3e-4f50-4a6b-8c7d-9e0f1a2b3c4d"
+		nodes := []string{"245bb2fe-b55c-44a0-9a1e-ab80e4b5f088", "7a1e9c3b-2d4f-4e6a-9b8c-0d1e2f3a4b5c"}
+
+		for _, nodeID := range nodes {
+			req := &csi.ControllerPublishVolumeRequest{
+				NodeId:           nodeID,
+				VolumeId:         volumeID,
+				VolumeCapability: capabilities[0],
+			}
+
+			// publishing twice must succeed with the same context
+			first, err := controller.ControllerPublishVolume(ctx, req)
+			if err != nil {
+				t.Fatalf("Expected no error, got error : %v", err)
+			}
+
+			second, err := controller.ControllerPublishVolume(ctx, req)
+			if err != nil {
+				t.Fatalf("Expected no error, got error : %v", err)
+			}
+
+			if len(first.PublishContext) == 0 || !reflect.DeepEqual(first.PublishContext, second.PublishContext) {
+				t.Errorf("expected the same publish context, got %v and %v", first.PublishContext, second.PublishContext)
+			}
+
+			// unpublishing twice must succeed and leave the volume free for the next node
+			for i := 0; i < 2; i++ {
+				_, err = controller.ControllerUnpublishVolume(ctx, &csi.ControllerUnpublishVolumeRequest{
+					NodeId:   nodeID,
+					VolumeId: volumeID,
+				})
+				if err != nil {
+					t.Fatalf("Expected no error, got error : %v", err)
+				}
+			}
+		}
+	})
+
+	t.Run("validate unsupported capability", func(t *testing.T) {
+		res, err := controller.ValidateVolumeCapabilities(ctx, &csi.ValidateVolumeCapabilitiesRequest{
+			VolumeId: "c56c7b6e-15c2-445e-9a5d-1063ab5828ec",
+			VolumeCapabilities: []*csi.VolumeCapability{
+				{
+					AccessType: &csi.VolumeCapability_Mount{
+						Mount: &csi.VolumeCapability_MountVolume{},
+					},
+					AccessMode: &csi.VolumeCapability_AccessMode{
+						Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER,
+					},
+				},
+			},
+		})
+		if err != nil {
+			t.Fatalf("Expected no error, got error : %v", err)
+		}
+
+		if res.Confirmed != nil {
+			t.Errorf("expected the capability not to be confirmed, got %+v", res)
+		}
+	})
+
+	t.Run("publish without node", func(t *testing.T) {
+		_, err := controller.ControllerPublishVolume(ctx, &csi.ControllerPublishVolumeRequest{
+			VolumeId:         "c56c7b6e-15c2-445e-9a5d-1063ab5828ec",
+			VolumeCapability: capabilities[0],
+		})
+		if status.Code(err) != codes.InvalidArgument {
+			t.Errorf("expected %v got %v", codes.InvalidArgument, err)
+		}
+	})
+
+	t.Run("snapshots", func(t *testing.T) {
+		_, err := controller.CreateSnapshot(ctx, &csi.CreateSnapshotRequest{})
+		if status.Code(err) != codes.Unimplemented {
+			t.Errorf("expected %v got %v", codes.Unimplemented, err)
+		}
+	})
+
+	t.Run("node info", func(t *testing.T) {
+		res, err := node.NodeGetInfo(ctx, &csi.NodeGetInfoRequest{})
+		if err != nil {
+			t.Fatalf("Expected no error, got error : %v", err)
+		}
+
+		if res.NodeId == "" || res.MaxVolumesPerNode <= 0 {
+			t.Errorf("expected a node ID and volume limit, got %+v", res)
+		}
+	})
+
+	t.Run("node stage without volume id", func(t *testing.T) {
+		_, err := node.NodeStageVolume(ctx, &csi.NodeStageVolumeRequest{
+			StagingTargetPath: "/mnt/staging",
+			VolumeCapability:  capabilities[0],
+		})
+		if status.Code(err) != codes.InvalidArgument {
+			t.Errorf("expected %v got %v", codes.InvalidArgument, err)
+		}
+	})
+}